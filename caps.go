@@ -0,0 +1,247 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// capID identifies a capability. A client's enabled capabilities are kept
+// as a bitmask so other goroutines can check them without locking.
+type capID uint
+
+const (
+	capCapNotify capID = iota
+	capMultiPrefix
+	capSASL
+	capServerTime
+	capMessageTags
+	capBatch
+	capChathistory
+	capInviteNotify
+)
+
+type capability struct {
+	id   capID
+	name string
+	// value returns the value advertised to CAP 302 clients, if any.
+	value func() string
+	// available reports whether the capability is currently offered. Nil
+	// means always.
+	available func() bool
+}
+
+// capabilities is everything the server supports, in advertised order.
+var capabilities = []capability{
+	{id: capCapNotify, name: "cap-notify"},
+	{id: capMultiPrefix, name: "multi-prefix"},
+	{id: capSASL, name: "sasl", value: saslCapValue},
+	{id: capServerTime, name: "server-time"},
+	{id: capMessageTags, name: "message-tags"},
+	{id: capBatch, name: "batch"},
+	{id: capChathistory, name: "draft/chathistory", available: historyEnabled},
+	{id: capInviteNotify, name: "invite-notify"},
+}
+
+func (c capability) isAvailable() bool {
+	return c.available == nil || c.available()
+}
+
+// capLineLength is the budget for a CAP reply, leaving room for CRLF.
+const capLineLength = 510
+
+func findCapability(name string) *capability {
+	for i := range capabilities {
+		if capabilities[i].name == name {
+			return &capabilities[i]
+		}
+	}
+	return nil
+}
+
+func (client *Client) hasCap(id capID) bool {
+	return client.caps.Load()&(1<<id) != 0
+}
+
+func (client *Client) enableCap(id capID) {
+	client.updateCaps(func(caps uint32) uint32 { return caps | 1<<id })
+}
+
+func (client *Client) disableCap(id capID) {
+	client.updateCaps(func(caps uint32) uint32 { return caps &^ (1 << id) })
+}
+
+func (client *Client) updateCaps(update func(uint32) uint32) {
+	for {
+		old := client.caps.Load()
+		if client.caps.CompareAndSwap(old, update(old)) {
+			return
+		}
+	}
+}
+
+// enabledCaps returns the names of the client's enabled capabilities.
+func (client *Client) enabledCaps() []string {
+	var names []string
+	for _, c := range capabilities {
+		if client.hasCap(c.id) {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
+
+// advertisedCap formats a capability for LS or NEW, with its value for
+// clients that negotiated CAP 302.
+func (client *Client) advertisedCap(c capability) string {
+	if client.capVersion.Load() >= 302 && c.value != nil {
+		if value := c.value(); value != "" {
+			return c.name + "=" + value
+		}
+	}
+	return c.name
+}
+
+func handleCap(client *Client, msg *Message) {
+	log.Printf("Handling CAP command: %v", msg.Params)
+	if len(msg.Params) < 1 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "CAP", "Not enough parameters")
+		return
+	}
+
+	subCommand := strings.ToUpper(msg.Params[0])
+	switch subCommand {
+	case "LS":
+		handleCapLs(client, msg.Param(1))
+	case "REQ":
+		handleCapReq(client, msg.Param(1))
+	case "LIST":
+		sendCapList(client, "LIST", client.enabledCaps())
+	case "END":
+		handleCapEnd(client)
+	default:
+		client.sendNumeric(ERR_INVALIDCAPCMD, subCommand, "Invalid CAP command")
+	}
+}
+
+// handleCapLs advertises the supported capabilities. A version of 302 or
+// later turns on capability values, multi-line replies and cap-notify.
+func handleCapLs(client *Client, version string) {
+	if client.ID == 0 {
+		client.capNegotiating = true
+	}
+
+	if v, err := strconv.Atoi(version); err == nil && int32(v) > client.capVersion.Load() {
+		client.capVersion.Store(int32(v))
+	}
+	if client.capVersion.Load() >= 302 {
+		client.enableCap(capCapNotify)
+	}
+
+	names := make([]string, 0, len(capabilities))
+	for _, c := range capabilities {
+		if c.isAvailable() {
+			names = append(names, client.advertisedCap(c))
+		}
+	}
+	sendCapList(client, "LS", names)
+}
+
+// handleCapReq enables or disables the requested capabilities. The request
+// is applied as a whole or not at all.
+func handleCapReq(client *Client, request string) {
+	if client.ID == 0 {
+		client.capNegotiating = true
+	}
+
+	var enable, disable []capID
+	for _, name := range strings.Fields(request) {
+		removing := strings.HasPrefix(name, "-")
+		c := findCapability(strings.TrimPrefix(name, "-"))
+		// cap-notify is implied by CAP 302 and can't be turned off there
+		if c == nil || (!removing && !c.isAvailable()) || (removing && c.id == capCapNotify && client.capVersion.Load() >= 302) {
+			client.send(newMessage(ServerNameString, "CAP", client.nickOrStar(), "NAK", request))
+			return
+		}
+		if removing {
+			disable = append(disable, c.id)
+		} else {
+			enable = append(enable, c.id)
+		}
+	}
+
+	for _, id := range enable {
+		client.enableCap(id)
+	}
+	for _, id := range disable {
+		client.disableCap(id)
+	}
+	client.send(newMessage(ServerNameString, "CAP", client.nickOrStar(), "ACK", request))
+}
+
+// handleCapEnd finishes negotiation and lets registration proceed. It does
+// nothing once the client is registered.
+func handleCapEnd(client *Client) {
+	if !client.capNegotiating {
+		return
+	}
+	// An unfinished SASL exchange is abandoned
+	abortSASL(client)
+	client.capNegotiating = false
+	tryCompleteRegistration(client)
+}
+
+// sendCapList sends a LS or LIST reply, split over several lines when it
+// doesn't fit in one. Continuation lines are marked with "*", which only
+// CAP 302 clients understand; older clients get a single line.
+func sendCapList(client *Client, subCommand string, names []string) {
+	nick := client.nickOrStar()
+	budget := capLineLength - len(":"+ServerNameString+" CAP "+nick+" "+subCommand+" * :")
+
+	var lines []string
+	var line strings.Builder
+	for _, name := range names {
+		if line.Len() > 0 && line.Len()+1+len(name) > budget && client.capVersion.Load() >= 302 {
+			lines = append(lines, line.String())
+			line.Reset()
+		}
+		if line.Len() > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(name)
+	}
+	lines = append(lines, line.String())
+
+	for i, text := range lines {
+		if i < len(lines)-1 {
+			client.send(newMessage(ServerNameString, "CAP", nick, subCommand, "*", text))
+		} else {
+			client.send(newMessage(ServerNameString, "CAP", nick, subCommand, text))
+		}
+	}
+}
+
+// notifyCapChange tells clients with cap-notify that capabilities became
+// available (NEW) or went away (DEL). Removed capabilities are disabled for
+// everyone.
+func notifyCapChange(subCommand string, changed []capability) {
+	for _, client := range connectedClientList() {
+		if subCommand == "DEL" {
+			for _, c := range changed {
+				client.disableCap(c.id)
+			}
+		}
+		if !client.hasCap(capCapNotify) {
+			continue
+		}
+		names := make([]string, 0, len(changed))
+		for _, c := range changed {
+			if subCommand == "NEW" {
+				names = append(names, client.advertisedCap(c))
+			} else {
+				names = append(names, c.name)
+			}
+		}
+		client.send(newMessage(ServerNameString, "CAP", client.nickOrStar(), subCommand, strings.Join(names, " ")))
+	}
+}
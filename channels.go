@@ -0,0 +1,456 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// memberModes holds a member's prefix modes in a channel. The bits are
+// ordered by rank, so comparing the highest bits compares privilege.
+type memberModes uint8
+
+const (
+	memberVoice memberModes = 1 << iota
+	memberHalfop
+	memberOp
+	memberAdmin
+	memberFounder
+)
+
+// prefixModes lists the prefix modes from highest rank to lowest, with the
+// mode letter and the symbol shown before nicknames.
+var prefixModes = []struct {
+	mode   memberModes
+	letter rune
+	symbol string
+}{
+	{memberFounder, 'q', "~"},
+	{memberAdmin, 'a', "&"},
+	{memberOp, 'o', "@"},
+	{memberHalfop, 'h', "%"},
+	{memberVoice, 'v', "+"},
+}
+
+func memberModeForLetter(letter rune) (memberModes, bool) {
+	for _, p := range prefixModes {
+		if p.letter == letter {
+			return p.mode, true
+		}
+	}
+	return 0, false
+}
+
+// prefixISupport is the PREFIX token, e.g. "(qaohv)~&@%+".
+func prefixISupport() string {
+	var letters, symbols strings.Builder
+	for _, p := range prefixModes {
+		letters.WriteRune(p.letter)
+		symbols.WriteString(p.symbol)
+	}
+	return "(" + letters.String() + ")" + symbols.String()
+}
+
+// highest returns the highest-ranked mode that is set, or zero.
+func (m memberModes) highest() memberModes {
+	for _, p := range prefixModes {
+		if m&p.mode != 0 {
+			return p.mode
+		}
+	}
+	return 0
+}
+
+func (m memberModes) atLeast(rank memberModes) bool {
+	return m.highest() >= rank
+}
+
+// prefix returns the highest-ranked prefix symbol for the modes.
+func (m memberModes) prefix() string {
+	for _, p := range prefixModes {
+		if m&p.mode != 0 {
+			return p.symbol
+		}
+	}
+	return ""
+}
+
+// prefixes returns every prefix symbol for the modes, highest first.
+func (m memberModes) prefixes() string {
+	var symbols strings.Builder
+	for _, p := range prefixModes {
+		if m&p.mode != 0 {
+			symbols.WriteString(p.symbol)
+		}
+	}
+	return symbols.String()
+}
+
+// prefixFor returns the prefixes as the viewer should see them: all of them
+// with multi-prefix, otherwise only the highest.
+func (m memberModes) prefixFor(viewer *Client) string {
+	if viewer.hasCap(capMultiPrefix) {
+		return m.prefixes()
+	}
+	return m.prefix()
+}
+
+// canSetMemberMode reports whether a member with modes m may give or take
+// mode. Halfops may only voice; ops and above may set modes up to their own
+// rank.
+func (m memberModes) canSetMemberMode(mode memberModes) bool {
+	rank := m.highest()
+	if rank == memberHalfop {
+		return mode == memberVoice
+	}
+	return rank >= memberOp && mode <= rank
+}
+
+// canActOn reports whether a member with modes m may kick, or remove prefix
+// modes from, a member with target's modes. Halfops only reach members
+// below them; ops and above reach anyone up to their own rank.
+func (m memberModes) canActOn(target memberModes) bool {
+	rank, targetRank := m.highest(), target.highest()
+	if rank == memberHalfop {
+		return targetRank < memberHalfop
+	}
+	return rank >= memberOp && targetRank <= rank
+}
+
+// Membership is a live client's presence in a channel. Memberships only
+// exist in memory; they are never persisted.
+type Membership struct {
+	Client   *Client
+	Modes    memberModes
+	JoinedAt time.Time
+
+	// Lines counted against the channel's +f since floodStart.
+	floodStart time.Time
+	floodLines int
+}
+
+// liveChannels is the authoritative set of channels used for routing. It
+// holds every registered channel plus every channel that currently has
+// members. channelsMutex guards the map, each channel's members and lists,
+// and each client's Channels slice.
+var liveChannels = make(map[string]*Channel)
+
+func channelKey(name string) string {
+	return strings.ToLower(name)
+}
+
+func findChannel(name string) *Channel {
+	channelsMutex.RLock()
+	defer channelsMutex.RUnlock()
+	return liveChannels[channelKey(name)]
+}
+
+// getOrCreateChannel returns the live channel with the given name, loading
+// it from the database or creating it if needed.
+func getOrCreateChannel(name string) (*Channel, error) {
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+
+	if channel, ok := liveChannels[channelKey(name)]; ok {
+		return channel, nil
+	}
+
+	channel, err := loadOrCreateChannelRecord(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := channel.loadLists(); err != nil {
+		return nil, err
+	}
+	channel.members = make(map[*Client]*Membership)
+	liveChannels[channelKey(channel.Name)] = channel
+	return channel, nil
+}
+
+// loadRegisteredChannels makes every registered channel live at startup so
+// it can be found before anyone joins it.
+func loadRegisteredChannels() error {
+	channels, err := getRegisteredChannels()
+	if err != nil {
+		return err
+	}
+
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+	for _, channel := range channels {
+		if err := channel.loadLists(); err != nil {
+			return err
+		}
+		channel.members = make(map[*Client]*Membership)
+		liveChannels[channelKey(channel.Name)] = channel
+	}
+	log.Printf("Loaded %d registered channels", len(channels))
+	return nil
+}
+
+func allChannels() []*Channel {
+	channelsMutex.RLock()
+	defer channelsMutex.RUnlock()
+
+	channels := make([]*Channel, 0, len(liveChannels))
+	for _, channel := range liveChannels {
+		channels = append(channels, channel)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+	return channels
+}
+
+func addClientToChannel(client *Client, channel *Channel, modes memberModes) {
+	log.Printf("Adding client %s to channel %s (modes: %s)", client.Nickname, channel.Name, modes.prefix())
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+
+	// The channel may have emptied and been dropped since it was looked up.
+	if _, ok := liveChannels[channelKey(channel.Name)]; !ok {
+		liveChannels[channelKey(channel.Name)] = channel
+	}
+
+	if _, ok := channel.members[client]; ok {
+		return
+	}
+	channel.members[client] = &Membership{Client: client, Modes: modes, JoinedAt: time.Now()}
+	client.Channels = append(client.Channels, channel)
+}
+
+// removeClientFromChannel drops the membership. Unregistered channels stop
+// being live once their last member leaves.
+func removeClientFromChannel(client *Client, channel *Channel) {
+	log.Printf("Removing client %s from channel %s", client.Nickname, channel.Name)
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+
+	delete(channel.members, client)
+
+	for i, ch := range client.Channels {
+		if ch == channel {
+			client.Channels = append(client.Channels[:i], client.Channels[i+1:]...)
+			break
+		}
+	}
+
+	if len(channel.members) == 0 && !channel.IsRegistered {
+		if liveChannels[channelKey(channel.Name)] == channel {
+			delete(liveChannels, channelKey(channel.Name))
+			log.Printf("Channel %s is empty and no longer live", channel.Name)
+		}
+	}
+}
+
+// clients returns a snapshot of the channel's members in join order.
+func (channel *Channel) clients() []*Client {
+	channelsMutex.RLock()
+	defer channelsMutex.RUnlock()
+
+	memberships := make([]*Membership, 0, len(channel.members))
+	for _, membership := range channel.members {
+		memberships = append(memberships, membership)
+	}
+	sort.Slice(memberships, func(i, j int) bool {
+		return memberships[i].JoinedAt.Before(memberships[j].JoinedAt)
+	})
+
+	clients := make([]*Client, len(memberships))
+	for i, membership := range memberships {
+		clients[i] = membership.Client
+	}
+	return clients
+}
+
+func (channel *Channel) memberCount() int {
+	channelsMutex.RLock()
+	defer channelsMutex.RUnlock()
+	return len(channel.members)
+}
+
+func (channel *Channel) hasMember(client *Client) bool {
+	channelsMutex.RLock()
+	defer channelsMutex.RUnlock()
+	_, ok := channel.members[client]
+	return ok
+}
+
+// memberModes returns the client's prefix modes and whether it is a member.
+func (channel *Channel) memberModes(client *Client) (memberModes, bool) {
+	channelsMutex.RLock()
+	defer channelsMutex.RUnlock()
+	membership, ok := channel.members[client]
+	if !ok {
+		return 0, false
+	}
+	return membership.Modes, true
+}
+
+// setMemberMode adds or removes a prefix mode and reports whether the
+// client is a member of the channel.
+func (channel *Channel) setMemberMode(client *Client, mode memberModes, adding bool) bool {
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+	membership, ok := channel.members[client]
+	if !ok {
+		return false
+	}
+	if adding {
+		membership.Modes |= mode
+	} else {
+		membership.Modes &^= mode
+	}
+	return true
+}
+
+// hasPrivilege reports whether the client holds rank or higher in the
+// channel.
+func (channel *Channel) hasPrivilege(client *Client, rank memberModes) bool {
+	modes, _ := channel.memberModes(client)
+	return modes.atLeast(rank)
+}
+
+// isOperator reports whether the client is a channel operator or above.
+func (channel *Channel) isOperator(client *Client) bool {
+	return channel.hasPrivilege(client, memberOp)
+}
+
+// channelList returns a snapshot of the channels the client is in.
+func (client *Client) channelList() []*Channel {
+	channelsMutex.RLock()
+	defer channelsMutex.RUnlock()
+	return append([]*Channel(nil), client.Channels...)
+}
+
+// channelPeers returns every other client sharing at least one channel with
+// the client, each listed once.
+func channelPeers(client *Client) []*Client {
+	channelsMutex.RLock()
+	defer channelsMutex.RUnlock()
+
+	seen := make(map[*Client]bool)
+	var peers []*Client
+	for _, channel := range client.Channels {
+		for member := range channel.members {
+			if member != client && !seen[member] {
+				seen[member] = true
+				peers = append(peers, member)
+			}
+		}
+	}
+	return peers
+}
+
+// addInvite lets the client past +i, +k and +l on its next join, until the
+// invite expires. Expired invites are dropped along the way.
+func (channel *Channel) addInvite(client *Client) {
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+
+	now := time.Now()
+	if channel.invites == nil {
+		channel.invites = make(map[*Client]time.Time)
+	}
+	for invited, expires := range channel.invites {
+		if now.After(expires) {
+			delete(channel.invites, invited)
+		}
+	}
+	channel.invites[client] = now.Add(config().Limits.InviteExpiry.Duration)
+}
+
+func (channel *Channel) isInvited(client *Client) bool {
+	channelsMutex.RLock()
+	defer channelsMutex.RUnlock()
+	expires, ok := channel.invites[client]
+	return ok && time.Now().Before(expires)
+}
+
+// removeInvite drops the client's invite once it has been used.
+func (channel *Channel) removeInvite(client *Client) {
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+	delete(channel.invites, client)
+}
+
+// invitedChannels returns the channels the client holds a live invite to.
+func invitedChannels(client *Client) []*Channel {
+	var channels []*Channel
+	for _, channel := range allChannels() {
+		if channel.isInvited(client) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// isHidden reports whether the channel is +s or +p.
+func (channel *Channel) isHidden() bool {
+	return channel.Secret || channel.Private
+}
+
+// isVisibleTo reports whether the client may see that the channel exists
+// and who is in it: +s and +p channels are only visible to their members.
+func (channel *Channel) isVisibleTo(client *Client) bool {
+	return !channel.isHidden() || channel.hasMember(client)
+}
+
+// namesSymbol is the channel type shown in RPL_NAMREPLY: "@" for secret,
+// "*" for private and "=" for public channels.
+func (channel *Channel) namesSymbol() string {
+	switch {
+	case channel.Secret:
+		return "@"
+	case channel.Private:
+		return "*"
+	}
+	return "="
+}
+
+// isBanned reports whether the client matches one of the channel's bans
+// and none of its exceptions.
+func (channel *Channel) isBanned(client *Client) bool {
+	return channel.matchesList(client, 'b') && !channel.matchesList(client, 'e')
+}
+
+// isQuieted reports whether the client matches a ban or quiet and none of
+// the channel's exceptions.
+func (channel *Channel) isQuieted(client *Client) bool {
+	return (channel.matchesList(client, 'b') || channel.matchesList(client, 'Q')) && !channel.matchesList(client, 'e')
+}
+
+// joinError checks the channel's bans and +i, +k and +l against a client
+// trying to join with key. It returns the numeric and reason to refuse the
+// join with, or an empty numeric if the client may join. A pending invite
+// gets past everything but bans, and an invite exception gets past +i.
+func (channel *Channel) joinError(client *Client, key string) (string, string) {
+	switch {
+	case channel.isBanned(client):
+		return ERR_BANNEDFROMCHAN, "Cannot join channel (+b)"
+	case channel.isInvited(client):
+		return "", ""
+	case channel.InviteOnly && !channel.matchesList(client, 'I'):
+		return ERR_INVITEONLYCHAN, "Cannot join channel (+i)"
+	case channel.Key.Valid && channel.Key.String != "" && key != channel.Key.String:
+		return ERR_BADCHANNELKEY, "Cannot join channel (+k)"
+	case channel.UserLimit > 0 && channel.memberCount() >= channel.UserLimit:
+		return ERR_CHANNELISFULL, "Cannot join channel (+l)"
+	}
+	return "", ""
+}
+
+// canSend reports whether the client may speak in the channel: +n keeps out
+// non-members, and +m, bans and quiets silence members without a prefix
+// mode.
+func (channel *Channel) canSend(client *Client) bool {
+	modes, isMember := channel.memberModes(client)
+	if !isMember {
+		return !channel.NoExternalMessages && !channel.Moderated && !channel.isQuieted(client)
+	}
+	if modes != 0 {
+		return true
+	}
+	return !channel.Moderated && !channel.isQuieted(client)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
 	"strconv"
@@ -42,6 +43,10 @@ func (cs *ChanServType) HandleMessage(sender *Client, message string) {
 		cs.handleOp(sender, parts[1:])
 	case "DEOP":
 		cs.handleDeop(sender, parts[1:])
+	case "BAN":
+		cs.handleBan(sender, parts[1:])
+	case "UNBAN":
+		cs.handleUnban(sender, parts[1:])
 	case "SET":
 		cs.handleSet(sender, parts[1:])
 	case "INFO":
@@ -65,7 +70,7 @@ func (cs *ChanServType) handleServerRegister(args []string) {
 	}
 
 	// Set the channel as registered in the database
-	err = setChannelRegistered(channel.ID, 0) // Use 0 as the founder ID for server-created channels
+	err = setChannelRegistered(channel, 0) // Use 0 as the founder ID for server-created channels
 	if err != nil {
 		log.Printf("ChanServ: Error setting channel %s as registered: %v", channelName, err)
 		return
@@ -86,8 +91,8 @@ func (cs *ChanServType) handleRegister(sender *Client, args []string) {
 	}
 
 	// Check if the channel exists
-	channel, err := getChannel(channelName)
-	if err != nil {
+	channel := findChannel(channelName)
+	if channel == nil {
 		cs.sendNotice(sender, fmt.Sprintf("Error: Channel %s does not exist.", channelName))
 		return
 	}
@@ -99,19 +104,13 @@ func (cs *ChanServType) handleRegister(sender *Client, args []string) {
 	}
 
 	// Check if the sender is in the channel and is an operator
-	isOperator, err := isClientChannelOperator(sender, channel)
-	if err != nil {
-		cs.sendNotice(sender, fmt.Sprintf("Error checking operator status: %v", err))
-		return
-	}
-
-	if !isOperator {
+	if !channel.isOperator(sender) {
 		cs.sendNotice(sender, "You must be a channel operator to register the channel.")
 		return
 	}
 
 	// Set the channel as registered in the database
-	err = setChannelRegistered(channel.ID, sender.ID)
+	err := setChannelRegistered(channel, sender.ID)
 	if err != nil {
 		cs.sendNotice(sender, fmt.Sprintf("Error registering channel: %v", err))
 		return
@@ -127,9 +126,9 @@ func (cs *ChanServType) handleOp(sender *Client, args []string) {
 	}
 
 	channelName, targetNick := args[0], args[1]
-	channel, err := getChannel(channelName)
-	if err != nil {
-		cs.sendNotice(sender, fmt.Sprintf("Error: %v", err))
+	channel := findChannel(channelName)
+	if channel == nil {
+		cs.sendNotice(sender, fmt.Sprintf("Error: Channel %s does not exist.", channelName))
 		return
 	}
 
@@ -145,19 +144,18 @@ func (cs *ChanServType) handleOp(sender *Client, args []string) {
 		return
 	}
 
-	targetClient, err := getClientByNickname(targetNick)
-	if err != nil {
+	targetClient := findClientByNickname(targetNick)
+	if targetClient == nil {
 		cs.sendNotice(sender, fmt.Sprintf("Error: User %s not found.", targetNick))
 		return
 	}
 
-	err = setClientChannelOperator(targetClient, channel, true)
-	if err != nil {
-		cs.sendNotice(sender, fmt.Sprintf("Error setting operator status: %v", err))
+	if !channel.setMemberMode(targetClient, memberOp, true) {
+		cs.sendNotice(sender, fmt.Sprintf("Error: User %s is not in %s.", targetNick, channelName))
 		return
 	}
 
-	broadcastToChannel(channel, fmt.Sprintf(":%s MODE %s +o %s\r\n", ChanServNick, channelName, targetNick))
+	broadcastToChannel(channel, newMessage(ChanServNick, "MODE", channelName, "+o", targetNick))
 	cs.sendNotice(sender, fmt.Sprintf("User %s is now an operator in %s.", targetNick, channelName))
 }
 
@@ -168,9 +166,9 @@ func (cs *ChanServType) handleDeop(sender *Client, args []string) {
 	}
 
 	channelName, targetNick := args[0], args[1]
-	channel, err := getChannel(channelName)
-	if err != nil {
-		cs.sendNotice(sender, fmt.Sprintf("Error: %v", err))
+	channel := findChannel(channelName)
+	if channel == nil {
+		cs.sendNotice(sender, fmt.Sprintf("Error: Channel %s does not exist.", channelName))
 		return
 	}
 
@@ -186,22 +184,104 @@ func (cs *ChanServType) handleDeop(sender *Client, args []string) {
 		return
 	}
 
-	targetClient, err := getClientByNickname(targetNick)
-	if err != nil {
+	targetClient := findClientByNickname(targetNick)
+	if targetClient == nil {
 		cs.sendNotice(sender, fmt.Sprintf("Error: User %s not found.", targetNick))
 		return
 	}
 
-	err = setClientChannelOperator(targetClient, channel, false)
-	if err != nil {
-		cs.sendNotice(sender, fmt.Sprintf("Error removing operator status: %v", err))
+	if !channel.setMemberMode(targetClient, memberOp, false) {
+		cs.sendNotice(sender, fmt.Sprintf("Error: User %s is not in %s.", targetNick, channelName))
 		return
 	}
 
-	broadcastToChannel(channel, fmt.Sprintf(":%s MODE %s -o %s\r\n", ChanServNick, channelName, targetNick))
+	broadcastToChannel(channel, newMessage(ChanServNick, "MODE", channelName, "-o", targetNick))
 	cs.sendNotice(sender, fmt.Sprintf("User %s is no longer an operator in %s.", targetNick, channelName))
 }
 
+// handleBan bans a mask from a channel, optionally for a limited time.
+func (cs *ChanServType) handleBan(sender *Client, args []string) {
+	if len(args) < 2 {
+		cs.sendNotice(sender, "Syntax: BAN <#channel> <mask> [duration]")
+		return
+	}
+
+	channelName, mask := args[0], normalizeMask(args[1])
+	channel := cs.findChannelToBan(sender, channelName)
+	if channel == nil {
+		return
+	}
+
+	var expires time.Time
+	if len(args) > 2 {
+		duration, err := parseListDuration(args[2])
+		if err != nil {
+			cs.sendNotice(sender, "Invalid duration. Use e.g. 30m, 12h or 7d.")
+			return
+		}
+		expires = time.Now().Add(duration)
+	}
+
+	if !setListEntry(sender, channel, findListMode('b'), true, mask, expires) {
+		cs.sendNotice(sender, fmt.Sprintf("%s was not added to the %s ban list.", mask, channel.Name))
+		return
+	}
+
+	broadcastToChannel(channel, newRelayMessage(ChanServNick, "MODE", channel.Name, "+b", mask))
+	kickBannedUsers(channel, mask)
+	if expires.IsZero() {
+		cs.sendNotice(sender, fmt.Sprintf("%s is now banned from %s.", mask, channel.Name))
+	} else {
+		cs.sendNotice(sender, fmt.Sprintf("%s is now banned from %s until %s.", mask, channel.Name, expires.Format(time.RFC1123)))
+	}
+}
+
+func (cs *ChanServType) handleUnban(sender *Client, args []string) {
+	if len(args) < 2 {
+		cs.sendNotice(sender, "Syntax: UNBAN <#channel> <mask>")
+		return
+	}
+
+	channelName, mask := args[0], normalizeMask(args[1])
+	channel := cs.findChannelToBan(sender, channelName)
+	if channel == nil {
+		return
+	}
+
+	if !setListEntry(sender, channel, findListMode('b'), false, mask, time.Time{}) {
+		cs.sendNotice(sender, fmt.Sprintf("%s is not on the %s ban list.", mask, channel.Name))
+		return
+	}
+
+	broadcastToChannel(channel, newRelayMessage(ChanServNick, "MODE", channel.Name, "-b", mask))
+	cs.sendNotice(sender, fmt.Sprintf("%s is no longer banned from %s.", mask, channel.Name))
+}
+
+// findChannelToBan looks up a channel for BAN or UNBAN and checks that the
+// sender is its founder or a halfop or above there. It reports problems to
+// the sender and returns nil.
+func (cs *ChanServType) findChannelToBan(sender *Client, channelName string) *Channel {
+	channel := findChannel(channelName)
+	if channel == nil {
+		cs.sendNotice(sender, fmt.Sprintf("Error: Channel %s does not exist.", channelName))
+		return nil
+	}
+
+	if channel.hasPrivilege(sender, memberHalfop) {
+		return channel
+	}
+	hasRight, err := cs.hasRightToOp(sender, channel)
+	if err != nil {
+		cs.sendNotice(sender, fmt.Sprintf("Error checking ban rights: %v", err))
+		return nil
+	}
+	if !hasRight {
+		cs.sendNotice(sender, "You don't have the right to ban users in this channel.")
+		return nil
+	}
+	return channel
+}
+
 func (cs *ChanServType) handleSet(sender *Client, args []string) {
 	if len(args) < 3 {
 		cs.sendNotice(sender, "Syntax: SET <#channel> <setting> <value>")
@@ -209,9 +289,9 @@ func (cs *ChanServType) handleSet(sender *Client, args []string) {
 	}
 
 	channelName, setting, value := args[0], strings.ToUpper(args[1]), args[2]
-	channel, err := getChannel(channelName)
-	if err != nil {
-		cs.sendNotice(sender, fmt.Sprintf("Error: %v", err))
+	channel := findChannel(channelName)
+	if channel == nil {
+		cs.sendNotice(sender, fmt.Sprintf("Error: Channel %s does not exist.", channelName))
 		return
 	}
 
@@ -255,7 +335,7 @@ func (cs *ChanServType) handleSet(sender *Client, args []string) {
 	}
 
 	cs.sendNotice(sender, fmt.Sprintf("Channel %s setting %s has been updated to: %s", channelName, setting, value))
-	broadcastToChannel(channel, fmt.Sprintf(":%s NOTICE %s :%s has changed the channel %s to: %s\r\n", ChanServNick, channelName, sender.Nickname, setting, value))
+	broadcastToChannel(channel, newMessage(ChanServNick, "NOTICE", channelName, fmt.Sprintf("%s has changed the channel %s to: %s", sender.Nickname, setting, value)))
 }
 
 func (cs *ChanServType) handleInfo(sender *Client, args []string) {
@@ -265,9 +345,9 @@ func (cs *ChanServType) handleInfo(sender *Client, args []string) {
 	}
 
 	channelName := args[0]
-	channel, err := getChannel(channelName)
-	if err != nil {
-		cs.sendNotice(sender, fmt.Sprintf("Error: %v", err))
+	channel := findChannel(channelName)
+	if channel == nil {
+		cs.sendNotice(sender, fmt.Sprintf("Error: Channel %s does not exist.", channelName))
 		return
 	}
 
@@ -279,7 +359,7 @@ func (cs *ChanServType) handleInfo(sender *Client, args []string) {
 	// Get the founder's nickname
 	var founderNick string
 	if channel.FounderID.Valid {
-		err = DB.QueryRow("SELECT nickname FROM users WHERE id = ?", channel.FounderID.Int64).Scan(&founderNick)
+		err := DB.QueryRow("SELECT nickname FROM users WHERE id = ?", channel.FounderID.Int64).Scan(&founderNick)
 		if err != nil {
 			log.Printf("Error getting founder nickname: %v", err)
 			founderNick = "Unknown"
@@ -290,12 +370,7 @@ func (cs *ChanServType) handleInfo(sender *Client, args []string) {
 	cs.sendNotice(sender, fmt.Sprintf("Founder: %s", founderNick))
 
 	// Get the number of users
-	userCount, err := getChannelUserCount(channel.ID)
-	if err != nil {
-		log.Printf("Error getting channel user count: %v", err)
-		userCount = 0
-	}
-	cs.sendNotice(sender, fmt.Sprintf("Users: %d", userCount))
+	cs.sendNotice(sender, fmt.Sprintf("Users: %d", channel.memberCount()))
 }
 
 func (cs *ChanServType) sendHelp(client *Client) {
@@ -303,12 +378,14 @@ func (cs *ChanServType) sendHelp(client *Client) {
 	cs.sendNotice(client, "REGISTER <#channel> - Register a channel")
 	cs.sendNotice(client, "OP <#channel> <nickname> - Give operator status to a user")
 	cs.sendNotice(client, "DEOP <#channel> <nickname> - Remove operator status from a user")
+	cs.sendNotice(client, "BAN <#channel> <mask> [duration] - Ban a mask, optionally for e.g. 30m, 12h or 7d")
+	cs.sendNotice(client, "UNBAN <#channel> <mask> - Remove a ban")
 	cs.sendNotice(client, "SET <#channel> <setting> <value> - Change channel settings")
 	cs.sendNotice(client, "INFO <#channel> - Get information about a channel")
 }
 
 func (cs *ChanServType) sendNotice(client *Client, message string) {
-	client.conn.Write([]byte(fmt.Sprintf(":%s NOTICE %s :%s\r\n", ChanServNick, client.Nickname, message)))
+	client.sendNotice(ChanServNick, message)
 }
 
 func (cs *ChanServType) hasRightToOp(sender *Client, channel *Channel) (bool, error) {
@@ -328,27 +405,22 @@ func (cs *ChanServType) hasRightToOp(sender *Client, channel *Channel) (bool, er
 
 // Add these functions to database.go:
 
-func setChannelRegistered(channelID int64, founderID int64) error {
-	_, err := DB.Exec("UPDATE channels SET is_registered = ?, founder_id = ? WHERE id = ?", true, founderID, channelID)
-	return err
-}
-
-func isClientChannelOperator(client *Client, channel *Channel) (bool, error) {
-	var isOperator bool
-	err := DB.QueryRow("SELECT is_operator FROM user_channels WHERE user_id = ? AND channel_id = ?", client.ID, channel.ID).Scan(&isOperator)
-	return isOperator, err
+func setChannelRegistered(channel *Channel, founderID int64) error {
+	_, err := DB.Exec("UPDATE channels SET is_registered = ?, founder_id = ? WHERE id = ?", true, founderID, channel.ID)
+	if err != nil {
+		return err
+	}
+	channel.IsRegistered = true
+	channel.FounderID = sql.NullInt64{Int64: founderID, Valid: true}
+	return nil
 }
 
 func isClientChannelFounder(client *Client, channel *Channel) (bool, error) {
-	var founderID int64
+	// Unregistered channels have no founder
+	var founderID sql.NullInt64
 	err := DB.QueryRow("SELECT founder_id FROM channels WHERE id = ?", channel.ID).Scan(&founderID)
 	if err != nil {
 		return false, err
 	}
-	return founderID == client.ID, nil
-}
-
-func setClientChannelOperator(client *Client, channel *Channel, isOperator bool) error {
-	_, err := DB.Exec("UPDATE user_channels SET is_operator = ? WHERE user_id = ? AND channel_id = ?", isOperator, client.ID, channel.ID)
-	return err
+	return founderID.Valid && founderID.Int64 == client.ID, nil
 }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config holds everything that used to be hardcoded per deployment. It is
+// loaded from a JSON file given with -config; any field left out of the file
+// keeps its default value.
+type Config struct {
+	ServerName      string           `json:"server_name"`
+	Listeners       []ListenerConfig `json:"listeners"`
+	DatabasePath    string           `json:"database_path"`
+	MotdPath        string           `json:"motd_path"`
+	PingInterval    Duration         `json:"ping_interval"`
+	PingTimeout     Duration         `json:"ping_timeout"`
+	DefaultChannels []string         `json:"default_channels"`
+	Limits          LimitsConfig     `json:"limits"`
+	Connections     ConnectionConfig `json:"connections"`
+	History         HistoryConfig    `json:"history"`
+	// OperClasses maps a class name to the privileges it grants.
+	OperClasses map[string][]string `json:"oper_classes"`
+	Operators   []OperatorConfig    `json:"operators"`
+}
+
+type ListenerConfig struct {
+	Address  string `json:"address"`
+	TLS      bool   `json:"tls"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+type LimitsConfig struct {
+	NickLength  int      `json:"nick_length"`
+	ReadTimeout Duration `json:"read_timeout"`
+	// SendQ is the most bytes that may wait in a client's send queue
+	// before the client is disconnected.
+	SendQ int `json:"sendq"`
+	// InviteExpiry is how long an unused INVITE stays valid.
+	InviteExpiry Duration `json:"invite_expiry"`
+	// RecvQ is the most bytes a client may have sent that the server hasn't
+	// processed yet before it is disconnected for Excess Flood.
+	RecvQ int `json:"recvq"`
+	// FloodBurst is how far ahead of real time a client's commands may get
+	// before the server starts delaying them.
+	FloodBurst Duration `json:"flood_burst"`
+}
+
+// ConnectionConfig limits who may connect and how often.
+type ConnectionConfig struct {
+	// MaxClients is the most connections the server accepts at once.
+	MaxClients int `json:"max_clients"`
+	// MaxPerIP and MaxPerCIDR cap concurrent connections from one address
+	// and from one network, whose size is set by CIDRv4 and CIDRv6.
+	MaxPerIP   int `json:"max_per_ip"`
+	MaxPerCIDR int `json:"max_per_cidr"`
+	CIDRv4     int `json:"cidr_v4"`
+	CIDRv6     int `json:"cidr_v6"`
+	// ThrottleDelay is the least time allowed between connections from one
+	// address. It doubles, up to ThrottleMaxDelay, every time an address
+	// reconnects too soon.
+	ThrottleDelay    Duration `json:"throttle_delay"`
+	ThrottleMaxDelay Duration `json:"throttle_max_delay"`
+	// Exempt addresses and CIDR ranges skip the per-address limits and the
+	// throttle, but not MaxClients.
+	Exempt []string `json:"exempt"`
+}
+
+// HistoryConfig controls message history storage and CHATHISTORY.
+type HistoryConfig struct {
+	Enabled bool `json:"enabled"`
+	// Retention is how long messages are kept; zero keeps them forever.
+	Retention Duration `json:"retention"`
+	// MaxMessages caps the messages kept per channel or conversation; zero
+	// means no cap.
+	MaxMessages int `json:"max_messages"`
+	// QueryLimit is the most messages a single CHATHISTORY request returns.
+	QueryLimit int `json:"query_limit"`
+}
+
+// Duration wraps time.Duration so it can be written as "30s" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// currentConfig is the running config. REHASH swaps it while clients are
+// reading it, so it is only read through config.
+var currentConfig atomic.Pointer[Config]
+
+func init() {
+	currentConfig.Store(defaultConfig())
+}
+
+func config() *Config {
+	return currentConfig.Load()
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ServerName:      "SquishIRC",
+		Listeners:       []ListenerConfig{{Address: ":6667"}},
+		DatabasePath:    "irc.db",
+		MotdPath:        "server.motd.txt",
+		PingInterval:    Duration{30 * time.Second},
+		PingTimeout:     Duration{60 * time.Second},
+		DefaultChannels: []string{"#general", "#help", "#random"},
+		Limits: LimitsConfig{
+			NickLength:   50,
+			ReadTimeout:  Duration{2 * time.Minute},
+			SendQ:        1 << 20,
+			InviteExpiry: Duration{time.Hour},
+			RecvQ:        8192,
+			FloodBurst:   Duration{10 * time.Second},
+		},
+		Connections: ConnectionConfig{
+			MaxClients:       1000,
+			MaxPerIP:         5,
+			MaxPerCIDR:       20,
+			CIDRv4:           24,
+			CIDRv6:           64,
+			ThrottleDelay:    Duration{2 * time.Second},
+			ThrottleMaxDelay: Duration{5 * time.Minute},
+			Exempt:           []string{"127.0.0.1", "::1"},
+		},
+		History: HistoryConfig{
+			Enabled:     true,
+			Retention:   Duration{30 * 24 * time.Hour},
+			MaxMessages: 10000,
+			QueryLimit:  100,
+		},
+	}
+}
+
+// loadConfig reads and validates the config file at path. An empty path
+// returns the defaults.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config file: %v", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	var errs []error
+
+	if cfg.ServerName == "" || strings.ContainsAny(cfg.ServerName, " \t:!@") {
+		errs = append(errs, fmt.Errorf("server_name %q must be non-empty and must not contain spaces, ':', '!' or '@'", cfg.ServerName))
+	}
+
+	if len(cfg.Listeners) == 0 {
+		errs = append(errs, errors.New("listeners must contain at least one entry"))
+	}
+	for i, listener := range cfg.Listeners {
+		if _, _, err := net.SplitHostPort(listener.Address); err != nil {
+			errs = append(errs, fmt.Errorf("listeners[%d].address %q: %v", i, listener.Address, err))
+		}
+		if listener.TLS && (listener.CertFile == "" || listener.KeyFile == "") {
+			errs = append(errs, fmt.Errorf("listeners[%d] has tls enabled but cert_file or key_file is missing", i))
+		}
+		if !listener.TLS && (listener.CertFile != "" || listener.KeyFile != "") {
+			errs = append(errs, fmt.Errorf("listeners[%d] sets cert_file or key_file but tls is not enabled", i))
+		}
+	}
+
+	if cfg.DatabasePath == "" {
+		errs = append(errs, errors.New("database_path must not be empty"))
+	}
+	if cfg.MotdPath == "" {
+		errs = append(errs, errors.New("motd_path must not be empty"))
+	}
+
+	if cfg.PingInterval.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("ping_interval must be positive, got %s", cfg.PingInterval))
+	}
+	if cfg.PingTimeout.Duration < cfg.PingInterval.Duration {
+		errs = append(errs, fmt.Errorf("ping_timeout (%s) must not be shorter than ping_interval (%s)", cfg.PingTimeout, cfg.PingInterval))
+	}
+
+	for i, channelName := range cfg.DefaultChannels {
+		if !strings.HasPrefix(channelName, "#") || strings.ContainsAny(channelName, " ,") {
+			errs = append(errs, fmt.Errorf("default_channels[%d] %q is not a valid channel name", i, channelName))
+		}
+	}
+
+	if cfg.Limits.NickLength <= 0 {
+		errs = append(errs, fmt.Errorf("limits.nick_length must be positive, got %d", cfg.Limits.NickLength))
+	}
+	if cfg.Limits.ReadTimeout.Duration <= cfg.PingInterval.Duration {
+		errs = append(errs, fmt.Errorf("limits.read_timeout (%s) must be longer than ping_interval (%s)", cfg.Limits.ReadTimeout, cfg.PingInterval))
+	}
+
+	if cfg.Limits.SendQ < 512 {
+		errs = append(errs, fmt.Errorf("limits.sendq must be at least 512 bytes, got %d", cfg.Limits.SendQ))
+	}
+	if cfg.Limits.RecvQ < 512 {
+		errs = append(errs, fmt.Errorf("limits.recvq must be at least 512 bytes, got %d", cfg.Limits.RecvQ))
+	}
+	if cfg.Limits.FloodBurst.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("limits.flood_burst must be positive, got %s", cfg.Limits.FloodBurst))
+	}
+	if cfg.Limits.InviteExpiry.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("limits.invite_expiry must be positive, got %s", cfg.Limits.InviteExpiry))
+	}
+
+	connections := cfg.Connections
+	if connections.MaxClients <= 0 {
+		errs = append(errs, fmt.Errorf("connections.max_clients must be positive, got %d", connections.MaxClients))
+	}
+	if connections.MaxPerIP <= 0 {
+		errs = append(errs, fmt.Errorf("connections.max_per_ip must be positive, got %d", connections.MaxPerIP))
+	}
+	if connections.MaxPerCIDR < connections.MaxPerIP {
+		errs = append(errs, fmt.Errorf("connections.max_per_cidr (%d) must not be less than max_per_ip (%d)", connections.MaxPerCIDR, connections.MaxPerIP))
+	}
+	if connections.CIDRv4 < 0 || connections.CIDRv4 > 32 {
+		errs = append(errs, fmt.Errorf("connections.cidr_v4 must be between 0 and 32, got %d", connections.CIDRv4))
+	}
+	if connections.CIDRv6 < 0 || connections.CIDRv6 > 128 {
+		errs = append(errs, fmt.Errorf("connections.cidr_v6 must be between 0 and 128, got %d", connections.CIDRv6))
+	}
+	if connections.ThrottleDelay.Duration < 0 {
+		errs = append(errs, fmt.Errorf("connections.throttle_delay must not be negative, got %s", connections.ThrottleDelay))
+	}
+	if connections.ThrottleMaxDelay.Duration < connections.ThrottleDelay.Duration {
+		errs = append(errs, fmt.Errorf("connections.throttle_max_delay (%s) must not be shorter than throttle_delay (%s)", connections.ThrottleMaxDelay, connections.ThrottleDelay))
+	}
+	for i, exempt := range connections.Exempt {
+		if _, err := parseAddressMask(exempt); err != nil {
+			errs = append(errs, fmt.Errorf("connections.exempt[%d]: %v", i, err))
+		}
+	}
+
+	for class, privileges := range cfg.OperClasses {
+		for _, privilege := range privileges {
+			if !slices.Contains(operPrivileges, privilege) {
+				errs = append(errs, fmt.Errorf("oper_classes.%s: unknown privilege %q", class, privilege))
+			}
+		}
+	}
+	operNames := make(map[string]bool)
+	for i, oper := range cfg.Operators {
+		if oper.Name == "" {
+			errs = append(errs, fmt.Errorf("operators[%d].name must not be empty", i))
+		} else if operNames[oper.Name] {
+			errs = append(errs, fmt.Errorf("operators[%d]: duplicate operator %q", i, oper.Name))
+		}
+		operNames[oper.Name] = true
+		if _, err := bcrypt.Cost([]byte(oper.Password)); err != nil {
+			errs = append(errs, fmt.Errorf("operators[%d].password must be a bcrypt hash: %v", i, err))
+		}
+		if len(oper.Hosts) == 0 {
+			errs = append(errs, fmt.Errorf("operators[%d].hosts must not be empty", i))
+		}
+		for _, host := range oper.Hosts {
+			if _, _, err := splitOperHost(host); err != nil {
+				errs = append(errs, fmt.Errorf("operators[%d].hosts: %v", i, err))
+			}
+		}
+		if _, ok := cfg.OperClasses[oper.Class]; !ok {
+			errs = append(errs, fmt.Errorf("operators[%d].class %q is not in oper_classes", i, oper.Class))
+		}
+	}
+
+	if cfg.History.Retention.Duration < 0 {
+		errs = append(errs, fmt.Errorf("history.retention must not be negative, got %s", cfg.History.Retention))
+	}
+	if cfg.History.MaxMessages < 0 {
+		errs = append(errs, fmt.Errorf("history.max_messages must not be negative, got %d", cfg.History.MaxMessages))
+	}
+	if cfg.History.QueryLimit <= 0 {
+		errs = append(errs, fmt.Errorf("history.query_limit must be positive, got %d", cfg.History.QueryLimit))
+	}
+
+	return errors.Join(errs...)
+}
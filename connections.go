@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"slices"
 	"strings"
 	"time"
 )
@@ -18,6 +19,8 @@ func handleConnection(conn net.Conn) {
 		}
 		log.Printf("Connection closed for %s", conn.RemoteAddr().String())
 		removeConnectedClient(client.Nickname)
+		client.closeSendQueue()
+		client.waitForWriter()
 		conn.Close()
 	}()
 
@@ -25,196 +28,262 @@ func handleConnection(conn net.Conn) {
 
 	log.Printf("New connection from %s", conn.RemoteAddr().String())
 
-	// Send a preliminary welcome message
-	_, err := conn.Write([]byte(fmt.Sprintf(":%s NOTICE Auth :*** Looking up your hostname...\r\n", ServerNameString)))
-	if err != nil {
-		log.Printf("Error sending initial message: %v", err)
+	if err := completeTLSHandshake(client); err != nil {
+		log.Printf("TLS handshake failed for %s: %v", conn.RemoteAddr().String(), err)
 		return
 	}
 
-	pingTicker := time.NewTicker(30 * time.Second)
+	client.startWriter()
+
+	// Send a preliminary welcome message
+	client.send(newMessage(ServerNameString, "NOTICE", "Auth", "*** Looking up your hostname..."))
+
+	pingTicker := time.NewTicker(config().PingInterval.Duration)
 	defer pingTicker.Stop()
 
 	lastPingResponse := time.Now()
 	var lastPingSent time.Time
 
+	lines := make(chan string, recvQueueLines)
+	go client.readLines(reader, lines)
+
 	log.Printf("Starting main loop for %s", conn.RemoteAddr().String())
 	for {
 		select {
 		case <-pingTicker.C:
-			if time.Since(lastPingResponse) > 60*time.Second && !lastPingSent.IsZero() {
+			// A client with lines still waiting is lagged, not gone
+			if time.Since(lastPingResponse) > config().PingTimeout.Duration && !lastPingSent.IsZero() && client.recvQBytes.Load() == 0 {
 				log.Printf("Ping timeout for %s", conn.RemoteAddr().String())
 				handleDisconnect(client, fmt.Errorf("ping timeout"))
 				return
 			}
 			log.Printf("Sending PING to %s", conn.RemoteAddr().String())
 			lastPingSent = time.Now()
-			_, err := conn.Write([]byte(fmt.Sprintf("PING :%s\r\n", ServerNameString)))
-			if err != nil {
-				log.Printf("Error sending PING: %v", err)
-				handleDisconnect(client, err)
+			client.send(newMessage("", "PING", ServerNameString))
+
+		case line, ok := <-lines:
+			if !ok {
+				log.Printf("Error reading from connection %s: %v", conn.RemoteAddr().String(), client.readErr)
+				handleDisconnect(client, client.readErr)
 				return
 			}
+			// Don't work through a backlog the server has given up on
+			if client.closeQuitReason() != "" {
+				handleDisconnect(client, nil)
+				return
+			}
+			client.recvQBytes.Add(-int64(len(line)))
 
-		default:
-			conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
-			message, err := reader.ReadString('\n')
+			line = strings.Trim(line, "\r\n")
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+
+			msg, err := parseMessage(line)
 			if err != nil {
-				log.Printf("Error reading from connection %s: %v", conn.RemoteAddr().String(), err)
-				handleDisconnect(client, err)
-				return
+				log.Printf("Error parsing message from %s: %v", conn.RemoteAddr().String(), err)
+				continue
 			}
+			log.Printf("Received message from %s: %s", conn.RemoteAddr().String(), redactMessage(msg))
 
-			log.Printf("Received message from %s: %s", conn.RemoteAddr().String(), strings.TrimSpace(message))
-			message = strings.Trim(message, "\r\n")
-			parts := strings.SplitN(message, " ", 2)
-
-			if len(parts) > 0 {
-				command := strings.ToUpper(parts[0])
-				params := ""
-				if len(parts) > 1 {
-					params = parts[1]
-				}
-				if command == "PONG" {
-					lastPingResponse = time.Now()
-					lastPingSent = time.Time{}
-					continue
-				}
-
-				if commandParser(client, command, params) {
-					log.Printf("Client %s requested disconnect", conn.RemoteAddr().String())
-					return
-				}
+			if msg.Command == "PONG" {
+				lastPingResponse = time.Now()
+				lastPingSent = time.Time{}
+				continue
+			}
+
+			client.throttle(msg.Command)
+			if commandParser(client, msg) {
+				log.Printf("Client %s requested disconnect", conn.RemoteAddr().String())
+				return
 			}
 		}
 	}
 }
 
-func commandParser(client *Client, command, params string) bool {
-	switch command {
+// redacted stands in for parameters that must not reach the log.
+const redacted = "<redacted>"
+
+// redactMessage returns msg as a line for the log, with passwords and SASL
+// payloads hidden. Only the command word of messages to NickServ and
+// ChanServ is kept, since their arguments may include a password.
+func redactMessage(msg *Message) string {
+	params := slices.Clone(msg.Params)
+	switch msg.Command {
+	case "AUTHENTICATE", "PASS":
+		for i := range params {
+			params[i] = redacted
+		}
+	case "OPER":
+		for i := 1; i < len(params); i++ {
+			params[i] = redacted
+		}
+	case "PRIVMSG", "NOTICE":
+		if len(params) > 1 && isServiceNick(params[0]) {
+			command, _, _ := strings.Cut(params[1], " ")
+			params[1] = command + " " + redacted
+		}
+	}
+	logged := *msg
+	logged.Params = params
+	return logged.String()
+}
+
+func isServiceNick(nick string) bool {
+	return strings.EqualFold(nick, "ChanServ") || strings.EqualFold(nick, NickServNick)
+}
+
+// preRegistrationCommands are the only commands a client may send before
+// registration completes.
+var preRegistrationCommands = map[string]bool{
+	"CAP":          true,
+	"AUTHENTICATE": true,
+	"NICK":         true,
+	"USER":         true,
+	"PING":         true,
+	"PONG":         true,
+	"QUIT":         true,
+}
+
+func commandParser(client *Client, msg *Message) bool {
+	if client.ID == 0 && !preRegistrationCommands[msg.Command] {
+		client.sendNumeric(ERR_NOTREGISTERED, "You have not registered")
+		return false
+	}
+
+	switch msg.Command {
 	case "PING":
-		client.conn.Write([]byte(fmt.Sprintf("PONG %s\r\n", params)))
+		client.send(newMessage(ServerNameString, "PONG", ServerNameString, msg.Param(0)))
 	case "NICK":
 		log.Println("command: nick")
-		sanitizedNickname := sanitizeString(params)
-		handleNick(client, sanitizedNickname)
+		handleNick(client, msg)
 	case "USER":
 		log.Println("command: user")
-		userParts := strings.SplitN(params, " ", 4)
-		if len(userParts) == 4 {
-			handleUser(client, userParts[0], userParts[1], userParts[3])
-		}
+		handleUser(client, msg)
 	case "NAMES":
 		log.Println("command: names")
-		targetAndChannel := strings.SplitN(params, " ", 2)
-		var channelName string
-		if len(targetAndChannel) > 1 {
-			channelName = sanitizeString(targetAndChannel[1])
-		}
-		handleNames(client, channelName)
+		handleNames(client, msg)
 	case "JOIN":
-		log.Printf("Received JOIN command: %s", params)
-		handleJoin(client, params)
+		log.Printf("Received JOIN command: %v", msg.Params)
+		handleJoin(client, msg)
 	case "PART":
 		log.Println("command: part")
-		sanitizedChannelName := sanitizeString(params)
-		handlePart(client, sanitizedChannelName)
+		handlePart(client, msg)
 	case "QUIT":
 		log.Println("command: quit")
-		handleQuit(client, params)
+		handleQuit(client, msg.Param(0))
 		return true
 	case "LIST":
 		log.Println("command: list")
-		handleList(client)
+		handleList(client, msg)
 	case "PRIVMSG":
 		log.Println("command: privmsg")
-		targetAndMessage := strings.SplitN(params, " ", 2)
-		if len(targetAndMessage) > 1 {
-			target, message := targetAndMessage[0], targetAndMessage[1]
-			if strings.EqualFold(target, "NickServ") {
-				log.Printf("NickServ command received from %s: %s", client.Nickname, message)
-				handleNickServMessage(client, strings.TrimPrefix(message, ":"))
-				// Send an acknowledgment to the client
-				client.conn.Write([]byte(fmt.Sprintf(":%s NOTICE %s :NickServ command processed\r\n", ServerNameString, client.Nickname)))
-			} else if strings.EqualFold(target, "ChanServ") {
-				log.Printf("ChanServ command received from %s: %s", client.Nickname, message)
-				ChanServ.HandleMessage(client, strings.TrimPrefix(message, ":"))
-				// Send an acknowledgment to the client
-				client.conn.Write([]byte(fmt.Sprintf(":%s NOTICE %s :ChanServ command processed\r\n", ServerNameString, client.Nickname)))
-			} else {
-				handlePrivmsg(client, target, message)
-			}
-		} else {
-			log.Printf("Invalid PRIVMSG format from %s: %s", client.Nickname, params)
-			client.conn.Write([]byte(fmt.Sprintf(":%s NOTICE %s :Invalid PRIVMSG format\r\n", ServerNameString, client.Nickname)))
-		}
+		handlePrivmsg(client, msg)
+	case "NOTICE":
+		log.Println("command: notice")
+		handleNotice(client, msg)
+	case "CHATHISTORY":
+		handleChathistory(client, msg)
+	case "TAGMSG":
+		handleTagmsg(client, msg)
 	case "MODE":
 		log.Println("command: mode")
-		modeParts := strings.SplitN(params, " ", 2)
-		if len(modeParts) > 1 {
-			handleMode(client, modeParts[0], modeParts[1])
-		}
+		handleMode(client, msg)
 	case "TOPIC":
 		log.Println("command: topic")
-		topicParts := strings.SplitN(params, " ", 2)
-		if len(topicParts) > 1 {
-			handleTopic(client, topicParts[0], topicParts[1])
-		} else {
-			handleTopic(client, topicParts[0], "")
-		}
+		handleTopic(client, msg)
 	case "CAP":
-		handleCap(client, params)
+		handleCap(client, msg)
+	case "AUTHENTICATE":
+		handleAuthenticate(client, msg)
 	case "MOTD":
 		sendMotd(client)
 	case "WHO":
 		log.Println("command: who")
-		targetParts := strings.SplitN(params, " ", 2)
-		handleWho(client, targetParts[0])
+		handleWho(client, msg)
 	case "WHOIS":
 		log.Println("command: whois")
-		targetParts := strings.SplitN(params, " ", 2)
-		handleWhois(client, targetParts[0])
+		handleWhois(client, msg)
+	case "INVITE":
+		log.Println("command: invite")
+		handleInvite(client, msg)
 	case "KICK":
 		log.Println("command: kick")
-		handleKick(client, params)
+		handleKick(client, msg)
 	case "BAN":
 		log.Println("command: ban")
-		handleBan(client, params)
+		handleBan(client, msg)
 	case "UNBAN":
 		log.Println("command: unban")
-		handleUnban(client, params)
+		handleUnban(client, msg)
+	case "OPER":
+		log.Println("command: oper")
+		handleOper(client, msg)
+	case "KILL":
+		log.Println("command: kill")
+		handleKill(client, msg)
+	case "WALLOPS":
+		log.Println("command: wallops")
+		handleWallops(client, msg)
+	case "GLOBOPS":
+		log.Println("command: globops")
+		handleGlobops(client, msg)
+	case "KLINE", "GLINE":
+		log.Println("command: kline")
+		handleServerBan(client, msg, kindKLine)
+	case "UNKLINE", "UNGLINE":
+		log.Println("command: unkline")
+		handleRemoveServerBan(client, msg, kindKLine)
+	case "DLINE", "ZLINE":
+		log.Println("command: dline")
+		handleServerBan(client, msg, kindDLine)
+	case "UNDLINE", "UNZLINE":
+		log.Println("command: undline")
+		handleRemoveServerBan(client, msg, kindDLine)
+	case "REHASH":
+		log.Println("command: rehash")
+		handleRehash(client, msg)
+	case "DIE":
+		log.Println("command: die")
+		handleDie(client, msg, false)
+	case "RESTART":
+		log.Println("command: restart")
+		handleDie(client, msg, true)
+	case "STATS":
+		log.Println("command: stats")
+		handleStats(client, msg)
 	case "BANLIST":
 		log.Println("command: banlist")
-		handleBanList(client, params)
+		handleBanList(client, msg)
 	default:
-		log.Printf("Unhandled command: %s\n", command)
-		client.conn.Write([]byte(fmt.Sprintf(":%s 421 %s %s :Unknown command\r\n", ServerNameString, client.Nickname, command)))
+		log.Printf("Unhandled command: %s\n", msg.Command)
+		client.sendNumeric(ERR_UNKNOWNCOMMAND, msg.Command, "Unknown command")
 	}
 	return false
 }
 
 func handleDisconnect(client *Client, err error) {
 	var quitMessage string
-	switch e := err.(type) {
-	case net.Error:
-		if e.Timeout() {
-			quitMessage = "Ping timeout"
-			log.Println("con: timeout:", client.conn.RemoteAddr().String())
-		} else {
-			quitMessage = "Connection error"
+	if reason := client.closeQuitReason(); reason != "" {
+		quitMessage = reason
+		log.Printf("con: closed by server (%s): %s", reason, client.conn.RemoteAddr().String())
+	} else {
+		switch e := err.(type) {
+		case net.Error:
+			if e.Timeout() {
+				quitMessage = "Ping timeout"
+				log.Println("con: timeout:", client.conn.RemoteAddr().String())
+			} else {
+				quitMessage = "Connection error"
+				log.Println("con: disconnect:", client.conn.RemoteAddr().String())
+			}
+		default:
+			quitMessage = "Client quit"
 			log.Println("con: disconnect:", client.conn.RemoteAddr().String())
 		}
-	default:
-		quitMessage = "Client quit"
-		log.Println("con: disconnect:", client.conn.RemoteAddr().String())
 	}
 
 	handleQuit(client, quitMessage)
-	// Remove client from all channels in the database
-	_, err = DB.Exec("DELETE FROM user_channels WHERE user_id = ?", client.ID)
-	if err != nil {
-		log.Printf("Error removing client from channels: %v", err)
-	}
 	// Update last_seen in the database
 	_, err = DB.Exec("UPDATE users SET last_seen = ? WHERE id = ?", time.Now(), client.ID)
 	if err != nil {
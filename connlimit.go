@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// connectionTracker counts open connections per address and network and
+// remembers recent connects for throttling. Connections are counted from
+// accept until the connection closes, registered or not.
+type connectionTracker struct {
+	mu        sync.Mutex
+	total     int
+	perIP     map[string]int
+	perCIDR   map[string]int
+	throttled map[string]*connectThrottle
+}
+
+// connectThrottle is the reconnect backoff for one address.
+type connectThrottle struct {
+	last  time.Time
+	delay time.Duration
+}
+
+var connections = &connectionTracker{
+	perIP:     make(map[string]int),
+	perCIDR:   make(map[string]int),
+	throttled: make(map[string]*connectThrottle),
+}
+
+// admit decides whether a new connection from ip may proceed. If it may,
+// the connection is counted and release must be called when it closes;
+// otherwise reason says why it was refused.
+func (tracker *connectionTracker) admit(ip net.IP) (release func(), reason string) {
+	limits := config().Connections
+	exempt := isConnectionExempt(ip)
+	ipKey, cidrKey := ip.String(), connectionNetwork(ip).String()
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if tracker.total >= limits.MaxClients {
+		return nil, "Sorry, server is full - try later"
+	}
+	if !exempt {
+		if tracker.throttle(ipKey) {
+			return nil, "Reconnecting too fast, throttled"
+		}
+		if tracker.perIP[ipKey] >= limits.MaxPerIP {
+			return nil, "Too many host connections (local)"
+		}
+		if tracker.perCIDR[cidrKey] >= limits.MaxPerCIDR {
+			return nil, "Too many connections from your network"
+		}
+	}
+
+	tracker.total++
+	tracker.perIP[ipKey]++
+	tracker.perCIDR[cidrKey]++
+
+	return func() {
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+		tracker.total--
+		decrementCount(tracker.perIP, ipKey)
+		decrementCount(tracker.perCIDR, cidrKey)
+	}, ""
+}
+
+// throttle records a connect from ipKey and reports whether it came too
+// soon after the last one. Each early reconnect doubles the delay the
+// address has to wait, up to the configured maximum; waiting out twice the
+// delay resets it. Callers hold tracker.mu.
+func (tracker *connectionTracker) throttle(ipKey string) bool {
+	limits := config().Connections
+	now := time.Now()
+
+	entry, ok := tracker.throttled[ipKey]
+	if !ok {
+		tracker.throttled[ipKey] = &connectThrottle{last: now, delay: limits.ThrottleDelay.Duration}
+		return false
+	}
+
+	elapsed := now.Sub(entry.last)
+	entry.last = now
+	if elapsed < entry.delay {
+		entry.delay = min(entry.delay*2, limits.ThrottleMaxDelay.Duration)
+		return true
+	}
+	if elapsed >= 2*entry.delay {
+		entry.delay = limits.ThrottleDelay.Duration
+	}
+	return false
+}
+
+// pruneThrottles forgets addresses that haven't connected for longer than
+// the longest backoff. It runs with the periodic maintenance.
+func (tracker *connectionTracker) pruneThrottles() {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	maxDelay := config().Connections.ThrottleMaxDelay.Duration
+	for ipKey, entry := range tracker.throttled {
+		if time.Since(entry.last) > maxDelay {
+			delete(tracker.throttled, ipKey)
+		}
+	}
+}
+
+func decrementCount(counts map[string]int, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+		return
+	}
+	counts[key]--
+}
+
+// connectionNetwork is the network ip is counted against for max_per_cidr.
+func connectionNetwork(ip net.IP) *net.IPNet {
+	limits := config().Connections
+	bits, size := limits.CIDRv6, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, size = ip4, limits.CIDRv4, 32
+	}
+	mask := net.CIDRMask(bits, size)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+func isConnectionExempt(ip net.IP) bool {
+	for _, exempt := range config().Connections.Exempt {
+		if network, err := parseAddressMask(exempt); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddressMask parses an IP address or CIDR range. A bare address is
+// treated as a range holding only itself.
+func parseAddressMask(s string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address or CIDR range", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// rejectConnection tells a connection it was refused and closes it. It runs
+// on its own goroutine so a slow peer can't hold up the accept loop, and
+// gives up after rejectTimeout, TLS handshake included.
+func rejectConnection(conn net.Conn, reason string) {
+	defer conn.Close()
+	log.Printf("Rejected connection from %s: %s", conn.RemoteAddr().String(), reason)
+
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+	}
+	host := conn.RemoteAddr().String()
+	if ip := remoteIP(conn); ip != nil {
+		host = ip.String()
+	}
+	fmt.Fprintf(conn, "ERROR :Closing Link: %s (%s)\r\n", host, reason)
+}
+
+// rejectTimeout bounds how long a refused connection is kept open.
+const rejectTimeout = 10 * time.Second
+
+// remoteIP is the address a connection came from, or nil if it has none.
+func remoteIP(conn net.Conn) net.IP {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -12,9 +12,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func startDB() (*sqlx.DB, error) {
-	dbPath := "irc.db"
-
+func startDB(dbPath string) (*sqlx.DB, error) {
 	// Check if the database file exists
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
 		log.Println("Database file does not exist. Creating a new one.")
@@ -62,32 +60,81 @@ func startDB() (*sqlx.DB, error) {
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			is_registered BOOLEAN DEFAULT 0,
 			founder_id INTEGER,
+			secret BOOLEAN DEFAULT 0,
+			private BOOLEAN DEFAULT 0,
+			flood TEXT DEFAULT '',
 			FOREIGN KEY (founder_id) REFERENCES users(id)
 		);
 
-		CREATE TABLE IF NOT EXISTS user_channels (
-			user_id INTEGER,
-			channel_id INTEGER,
-			is_operator BOOLEAN DEFAULT 0,
-			has_voice BOOLEAN DEFAULT 0,
-			joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			PRIMARY KEY (user_id, channel_id),
-			FOREIGN KEY (user_id) REFERENCES users(id),
+		CREATE TABLE IF NOT EXISTS channel_lists (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel_id INTEGER NOT NULL,
+			mode TEXT NOT NULL,
+			mask TEXT NOT NULL COLLATE NOCASE,
+			set_by TEXT NOT NULL,
+			set_at INTEGER NOT NULL,
+			expires_at INTEGER,
+			UNIQUE (channel_id, mode, mask),
 			FOREIGN KEY (channel_id) REFERENCES channels(id)
 		);
 
-		CREATE TABLE IF NOT EXISTS channel_bans (
+		CREATE TABLE IF NOT EXISTS server_bans (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			channel_id INTEGER,
-			mask TEXT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (channel_id) REFERENCES channels(id)
+			kind TEXT NOT NULL,
+			mask TEXT NOT NULL COLLATE NOCASE,
+			reason TEXT NOT NULL,
+			set_by TEXT NOT NULL,
+			set_at INTEGER NOT NULL,
+			expires_at INTEGER,
+			UNIQUE (kind, mask)
+		);
+
+		CREATE TABLE IF NOT EXISTS scram_credentials (
+			user_id INTEGER PRIMARY KEY,
+			salt BLOB,
+			iterations INTEGER,
+			stored_key BLOB,
+			server_key BLOB,
+			FOREIGN KEY (user_id) REFERENCES users(id)
 		);
+
+		CREATE TABLE IF NOT EXISTS message_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			target TEXT NOT NULL,
+			msgid TEXT NOT NULL UNIQUE,
+			sent_at INTEGER NOT NULL,
+			sender TEXT NOT NULL,
+			source TEXT NOT NULL,
+			recipient TEXT NOT NULL,
+			command TEXT NOT NULL,
+			message TEXT NOT NULL,
+			tags TEXT NOT NULL DEFAULT ''
+		);
+
+		CREATE INDEX IF NOT EXISTS message_history_target ON message_history (target, sent_at, id);
 	`)
 	if err != nil {
 		return nil, fmt.Errorf("error creating tables: %v", err)
 	}
 
+	if err := addColumnIfMissing(db, "channel_lists", "expires_at", "INTEGER"); err != nil {
+		return nil, fmt.Errorf("error adding channel_lists.expires_at: %v", err)
+	}
+	for _, column := range []string{"secret", "private"} {
+		if err := addColumnIfMissing(db, "channels", column, "BOOLEAN DEFAULT 0"); err != nil {
+			return nil, fmt.Errorf("error adding channels.%s: %v", column, err)
+		}
+	}
+	if err := addColumnIfMissing(db, "channels", "flood", "TEXT DEFAULT ''"); err != nil {
+		return nil, fmt.Errorf("error adding channels.flood: %v", err)
+	}
+	if err := migrateChannelBans(db); err != nil {
+		return nil, fmt.Errorf("error migrating channel bans: %v", err)
+	}
+	if err := uniqueNicknamesIgnoringCase(db); err != nil {
+		return nil, fmt.Errorf("error making nicknames case-insensitive: %v", err)
+	}
+
 	log.Println("Database initialized successfully")
 	return db, nil
 }
@@ -99,11 +146,12 @@ func getClientByNickname(nickname string) (*Client, error) {
 			   COALESCE(hostname, '') as hostname, 
 			   COALESCE(realname, '') as realname, 
 			   COALESCE(password, '') as password, 
-			   invisible, is_operator, has_voice, created_at, 
+			   invisible, has_voice, created_at, 
 			   is_identified, last_seen, 
 			   COALESCE(email, '') as email 
 		FROM users 
-		WHERE nickname = ?
+		WHERE nickname = ? COLLATE NOCASE
+		ORDER BY id LIMIT 1
 	`
 	err := DB.Get(&client, query, nickname)
 	if err != nil {
@@ -112,6 +160,12 @@ func getClientByNickname(nickname string) (*Client, error) {
 	return &client, nil
 }
 
+func getNicknameByID(id int64) (string, error) {
+	var nickname string
+	err := DB.Get(&nickname, "SELECT nickname FROM users WHERE id = ?", id)
+	return nickname, err
+}
+
 func updateClientInfo(client *Client) error {
 	_, err := DB.Exec(`
 		UPDATE users 
@@ -137,20 +191,18 @@ func createClient(client *Client) error {
 	return nil
 }
 
-func getOrCreateChannel(name string) (*Channel, error) {
+// loadOrCreateChannelRecord fetches the channel's row, creating it if it
+// does not exist yet. Callers should go through getOrCreateChannel so the
+// channel becomes live.
+func loadOrCreateChannelRecord(name string) (*Channel, error) {
 	// Reject attempts to create a channel named "na"
 	if strings.EqualFold(name, "#na") {
 		return nil, fmt.Errorf("invalid channel name: %s", name)
 	}
 
 	var channel Channel
-	err := DB.Get(&channel, "SELECT * FROM channels WHERE name = ?", name)
+	err := DB.Get(&channel, "SELECT * FROM channels WHERE lower(name) = lower(?)", name)
 	if err == nil {
-		// Channel exists, fetch its clients
-		channel.Clients, err = getClientsInChannel(&channel)
-		if err != nil {
-			return nil, fmt.Errorf("error fetching clients for channel %s: %v", name, err)
-		}
 		return &channel, nil
 	}
 	if err != sql.ErrNoRows {
@@ -178,144 +230,269 @@ func getOrCreateChannel(name string) (*Channel, error) {
 		Topic:     "Welcome to " + name,
 		Key:       sql.NullString{String: "", Valid: false},
 		CreatedAt: time.Now(),
-		Clients:   []*Client{},
 	}
 	return &channel, nil
 }
 
-func addClientToChannel(client *Client, channel *Channel, isOperator bool) error {
-	log.Printf("Adding client %s to channel %s (isOperator: %v)", client.Nickname, channel.Name, isOperator)
-	_, err := DB.Exec(`
-		INSERT INTO user_channels (user_id, channel_id, is_operator)
-		VALUES (?, ?, ?)
-	`, client.ID, channel.ID, isOperator)
-	if err != nil {
-		log.Printf("Error executing SQL to add client to channel: %v", err)
+func getRegisteredChannels() ([]*Channel, error) {
+	var channels []*Channel
+	err := DB.Select(&channels, "SELECT * FROM channels WHERE is_registered = 1")
+	return channels, err
+}
+
+func updateClientNickname(client *Client) error {
+	_, err := DB.Exec("UPDATE users SET nickname = ? WHERE id = ?", client.Nickname, client.ID)
+	return err
+}
+
+// addColumnIfMissing adds a column to a table created by an older version.
+func addColumnIfMissing(db *sqlx.DB, table, column, definition string) error {
+	var count int
+	err := db.Get(&count, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column)
+	if err != nil || count > 0 {
 		return err
 	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
 
-	// Update the client's IsOperator status
-	if isOperator {
-		client.IsOperator = true
+// uniqueNicknamesIgnoringCase makes users.nickname unique without regard to
+// ASCII case, matching CASEMAPPING=ascii. Older databases may hold nicks
+// that differ only in case; unregistered ones give way to a registered nick
+// or an older record. Two registered accounts that collide are left for an
+// admin to sort out.
+func uniqueNicknamesIgnoringCase(db *sqlx.DB) error {
+	result, err := db.Exec(`
+		DELETE FROM users
+		WHERE COALESCE(password, '') = '' AND EXISTS (
+			SELECT 1 FROM users other
+			WHERE other.nickname = users.nickname COLLATE NOCASE AND other.id != users.id
+				AND (COALESCE(other.password, '') != '' OR other.id < users.id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	if removed, _ := result.RowsAffected(); removed > 0 {
+		log.Printf("Removed %d unregistered users whose nicknames differ from another only in case", removed)
 	}
 
-	log.Printf("Successfully added client %s to channel %s in the database", client.Nickname, channel.Name)
+	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_nickname_nocase ON users (nickname COLLATE NOCASE)")
+	if err != nil {
+		log.Printf("Registered nicknames differ only in case, so they can't be made unique: %v", err)
+	}
 	return nil
 }
 
-func removeClientFromChannel(client *Client, channel *Channel) error {
-	log.Printf("Attempting to remove client %s from channel %s", client.Nickname, channel.Name)
-	// Remove from database
-	_, err := DB.Exec(`
-		DELETE FROM user_channels
-		WHERE user_id = ? AND channel_id = ?
-	`, client.ID, channel.ID)
-	if err != nil {
-		log.Printf("Error removing client %s from channel %s in database: %v", client.Nickname, channel.Name, err)
+// migrateChannelBans moves bans from the old channel_bans table into
+// channel_lists and drops it.
+func migrateChannelBans(db *sqlx.DB) error {
+	var count int
+	if err := db.Get(&count, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'channel_bans'"); err != nil || count == 0 {
 		return err
 	}
-	log.Printf("Successfully removed client %s from channel %s in database", client.Nickname, channel.Name)
 
-	// Remove the channel from the client's list of channels
-	for i, ch := range client.Channels {
-		if ch.ID == channel.ID {
-			client.Channels = append(client.Channels[:i], client.Channels[i+1:]...)
-			log.Printf("Removed channel %s from client %s's channel list", channel.Name, client.Nickname)
-			break
-		}
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT OR IGNORE INTO channel_lists (channel_id, mode, mask, set_by, set_at)
+		SELECT channel_id, 'b', mask, ?, COALESCE(CAST(strftime('%s', created_at) AS INTEGER), 0)
+		FROM channel_bans
+		WHERE channel_id IS NOT NULL AND mask IS NOT NULL
+	`, ServerNameString)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DROP TABLE channel_bans"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
 	}
 
+	migrated, _ := result.RowsAffected()
+	log.Printf("Migrated %d channel bans to channel_lists", migrated)
 	return nil
 }
 
-func getClientsInChannel(channel *Channel) ([]*Client, error) {
-	var clients []*Client
-	query := `
-		SELECT u.id, u.nickname, u.username, 
-			   COALESCE(u.hostname, '') as hostname, 
-			   COALESCE(u.realname, '') as realname, 
-			   u.invisible, u.is_operator, u.has_voice, u.created_at, 
-			   u.is_identified, u.last_seen, 
-			   COALESCE(u.email, '') as email
-		FROM users u
-		JOIN user_channels uc ON u.id = uc.user_id
-		WHERE uc.channel_id = ?
-	`
-	err := DB.Select(&clients, query, channel.ID)
-	return clients, err
+// listEntry is one mask on a channel's ban, exception, invite exception or
+// quiet list. ExpiresAt is unset for entries that never expire.
+type listEntry struct {
+	Mode      string        `db:"mode"`
+	Mask      string        `db:"mask"`
+	SetBy     string        `db:"set_by"`
+	SetAt     int64         `db:"set_at"`
+	ExpiresAt sql.NullInt64 `db:"expires_at"`
 }
 
-func getAllChannels() ([]*Channel, error) {
-	var channels []*Channel
-	err := DB.Select(&channels, "SELECT * FROM channels")
-	return channels, err
+// addChannelListEntry adds a mask to one of the channel's lists and reports
+// whether it was new.
+func addChannelListEntry(channelID int64, entry listEntry) (bool, error) {
+	result, err := DB.Exec(`
+		INSERT OR IGNORE INTO channel_lists (channel_id, mode, mask, set_by, set_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, channelID, entry.Mode, entry.Mask, entry.SetBy, entry.SetAt, entry.ExpiresAt)
+	if err != nil {
+		return false, err
+	}
+	added, err := result.RowsAffected()
+	return added > 0, err
 }
 
-func getChannelUserCount(channelID int64) (int, error) {
-	var count int
-	err := DB.Get(&count, "SELECT COUNT(*) FROM user_channels WHERE channel_id = ?", channelID)
-	return count, err
+// removeChannelListEntry removes a mask from one of the channel's lists and
+// reports whether it was there.
+func removeChannelListEntry(channelID int64, mode rune, mask string) (bool, error) {
+	result, err := DB.Exec(`
+		DELETE FROM channel_lists
+		WHERE channel_id = ? AND mode = ? AND mask = ?
+	`, channelID, string(mode), mask)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
 }
 
-func updateClientNickname(client *Client) error {
-	_, err := DB.Exec("UPDATE users SET nickname = ? WHERE id = ?", client.Nickname, client.ID)
-	return err
+// getChannelLists returns the entries on all of the channel's lists that
+// haven't expired.
+func getChannelLists(channelID int64) ([]listEntry, error) {
+	var entries []listEntry
+	err := DB.Select(&entries, `
+		SELECT mode, mask, set_by, set_at, expires_at FROM channel_lists
+		WHERE channel_id = ? AND (expires_at IS NULL OR expires_at > ?)
+		ORDER BY id
+	`, channelID, time.Now().Unix())
+	return entries, err
 }
 
-func isClientInChannel(client *Client, channel *Channel) (bool, error) {
-	var count int
-	err := DB.QueryRow("SELECT COUNT(*) FROM user_channels WHERE user_id = ? AND channel_id = ?", client.ID, channel.ID).Scan(&count)
-	if err != nil {
-		return false, err
-	}
-	return count > 0, nil
+// expiredListEntry is a list entry removed because its time ran out.
+type expiredListEntry struct {
+	ChannelName string `db:"name"`
+	listEntry
 }
 
-func getChannel(name string) (*Channel, error) {
-	var channel Channel
-	err := DB.Get(&channel, "SELECT * FROM channels WHERE name = ?", name)
+// removeExpiredListEntries deletes every list entry that expired by now and
+// returns them.
+func removeExpiredListEntries(now time.Time) ([]expiredListEntry, error) {
+	tx, err := DB.Beginx()
 	if err != nil {
 		return nil, err
 	}
-	return &channel, nil
+	defer tx.Rollback()
+
+	var entries []expiredListEntry
+	err = tx.Select(&entries, `
+		SELECT c.name, l.mode, l.mask, l.set_by, l.set_at, l.expires_at
+		FROM channel_lists l JOIN channels c ON c.id = l.channel_id
+		WHERE l.expires_at IS NOT NULL AND l.expires_at <= ?
+		ORDER BY l.id
+	`, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM channel_lists WHERE expires_at IS NOT NULL AND expires_at <= ?", now.Unix()); err != nil {
+		return nil, err
+	}
+	return entries, tx.Commit()
 }
 
-func addChannelBan(channelID int64, mask string) error {
-	_, err := DB.Exec(`
-		INSERT INTO channel_bans (channel_id, mask)
-		VALUES (?, ?)
-	`, channelID, mask)
-	return err
+// serverBan is a K-line (kind "K", a user@host mask) or D-line (kind "D",
+// an IP address or CIDR range).
+type serverBan struct {
+	Kind      string        `db:"kind"`
+	Mask      string        `db:"mask"`
+	Reason    string        `db:"reason"`
+	SetBy     string        `db:"set_by"`
+	SetAt     int64         `db:"set_at"`
+	ExpiresAt sql.NullInt64 `db:"expires_at"`
 }
 
-func removeChannelBan(channelID int64, mask string) error {
+// addServerBan stores a server ban, replacing the reason and expiry of an
+// existing ban on the same mask.
+func addServerBan(ban serverBan) error {
 	_, err := DB.Exec(`
-		DELETE FROM channel_bans
-		WHERE channel_id = ? AND mask = ?
-	`, channelID, mask)
+		INSERT INTO server_bans (kind, mask, reason, set_by, set_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (kind, mask) DO UPDATE SET
+			reason = excluded.reason, set_by = excluded.set_by,
+			set_at = excluded.set_at, expires_at = excluded.expires_at
+	`, ban.Kind, ban.Mask, ban.Reason, ban.SetBy, ban.SetAt, ban.ExpiresAt)
 	return err
 }
 
-func isClientBanned(client *Client, channel *Channel) (bool, error) {
-	var banned bool
-	err := DB.QueryRow(`
-		SELECT EXISTS (
-			SELECT 1 FROM channel_bans
-			WHERE channel_id = ? AND (
-				? LIKE mask OR
-				? LIKE mask OR
-				? LIKE mask
-			)
-		)
-	`, channel.ID,
-		client.Nickname+"!"+client.Username+"@"+client.Hostname,
-		client.Username+"@"+client.Hostname,
-		client.Hostname).Scan(&banned)
-	return banned, err
+// removeServerBan removes a server ban and reports whether it existed.
+func removeServerBan(kind, mask string) (bool, error) {
+	result, err := DB.Exec("DELETE FROM server_bans WHERE kind = ? AND mask = ?", kind, mask)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
 }
 
-func getChannelBans(channelID int64) ([]string, error) {
-	var bans []string
-	err := DB.Select(&bans, "SELECT mask FROM channel_bans WHERE channel_id = ?", channelID)
+// getServerBans returns every server ban that hasn't expired.
+func getServerBans() ([]serverBan, error) {
+	var bans []serverBan
+	err := DB.Select(&bans, `
+		SELECT kind, mask, reason, set_by, set_at, expires_at FROM server_bans
+		WHERE expires_at IS NULL OR expires_at > ?
+		ORDER BY id
+	`, time.Now().Unix())
 	return bans, err
 }
+
+// removeExpiredServerBans deletes every server ban that expired by now and
+// returns them.
+func removeExpiredServerBans(now time.Time) ([]serverBan, error) {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var bans []serverBan
+	err = tx.Select(&bans, `
+		SELECT kind, mask, reason, set_by, set_at, expires_at FROM server_bans
+		WHERE expires_at IS NOT NULL AND expires_at <= ?
+		ORDER BY id
+	`, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM server_bans WHERE expires_at IS NOT NULL AND expires_at <= ?", now.Unix()); err != nil {
+		return nil, err
+	}
+	return bans, tx.Commit()
+}
+
+// scramCredentials are the SCRAM-SHA-256 verifiers for a user. bcrypt hashes
+// can't be used for SCRAM, so these are derived whenever the plaintext
+// password is at hand.
+type scramCredentials struct {
+	UserID     int64  `db:"user_id"`
+	Salt       []byte `db:"salt"`
+	Iterations int    `db:"iterations"`
+	StoredKey  []byte `db:"stored_key"`
+	ServerKey  []byte `db:"server_key"`
+}
+
+func getScramCredentials(userID int64) (*scramCredentials, error) {
+	var creds scramCredentials
+	err := DB.Get(&creds, "SELECT * FROM scram_credentials WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	return &creds, nil
+}
+
+func saveScramCredentials(creds *scramCredentials) error {
+	_, err := DB.Exec(`
+		INSERT OR REPLACE INTO scram_credentials (user_id, salt, iterations, stored_key, server_key)
+		VALUES (?, ?, ?, ?, ?)
+	`, creds.UserID, creds.Salt, creds.Iterations, creds.StoredKey, creds.ServerKey)
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// extbanPrefix starts an extended ban. "$~" negates the match.
+const extbanPrefix = "$"
+
+// extbanType is one kind of extended ban, matched against the text after
+// the colon.
+type extbanType struct {
+	letter byte
+	// needsArg types must have ":argument"; the others may omit it.
+	needsArg bool
+	match    func(client *Client, arg string) bool
+}
+
+// extbanTypes are the supported extended bans, in advertised order:
+//
+//	$a          any identified user; $a:name an account matching name
+//	$c:#chan    members of #chan
+//	$r:mask     users whose realname matches mask
+//	$z          users not on TLS; $z:fp a TLS client certificate fingerprint
+var extbanTypes = []extbanType{
+	{letter: 'a', match: func(client *Client, arg string) bool {
+		return client.Account != "" && (arg == "" || globMatch(arg, client.Account))
+	}},
+	{letter: 'c', needsArg: true, match: func(client *Client, arg string) bool {
+		channel := findChannel(arg)
+		return channel != nil && channel.hasMember(client)
+	}},
+	{letter: 'r', needsArg: true, match: func(client *Client, arg string) bool {
+		return globMatch(arg, client.Realname)
+	}},
+	{letter: 'z', match: func(client *Client, arg string) bool {
+		if arg == "" {
+			return !client.IsSecure
+		}
+		return client.CertFP != "" && strings.EqualFold(arg, client.CertFP)
+	}},
+}
+
+// extban is a parsed extended ban such as "$~a" or "$r:*bot*".
+type extban struct {
+	kind    *extbanType
+	negated bool
+	arg     string
+}
+
+func isExtban(mask string) bool {
+	return strings.HasPrefix(mask, extbanPrefix)
+}
+
+// parseExtban parses an extended ban mask, reporting why it is invalid.
+func parseExtban(mask string) (extban, error) {
+	spec, arg, hasArg := strings.Cut(strings.TrimPrefix(mask, extbanPrefix), ":")
+	var ban extban
+	if strings.HasPrefix(spec, "~") {
+		ban.negated = true
+		spec = spec[1:]
+	}
+	if len(spec) != 1 {
+		return ban, fmt.Errorf("malformed extban %s", mask)
+	}
+	for i := range extbanTypes {
+		if extbanTypes[i].letter == spec[0] {
+			ban.kind = &extbanTypes[i]
+		}
+	}
+	if ban.kind == nil {
+		return ban, fmt.Errorf("unknown extban type %s", spec)
+	}
+	if ban.kind.needsArg && (!hasArg || arg == "") {
+		return ban, fmt.Errorf("extban type %s needs an argument", spec)
+	}
+	ban.arg = arg
+	return ban, nil
+}
+
+func (ban extban) matches(client *Client) bool {
+	return ban.kind.match(client, ban.arg) != ban.negated
+}
+
+// extbanISupport is the EXTBAN token, e.g. "$,acrz".
+func extbanISupport() string {
+	letters := make([]byte, len(extbanTypes))
+	for i, kind := range extbanTypes {
+		letters[i] = kind.letter
+	}
+	return extbanPrefix + "," + string(letters)
+}
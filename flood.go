@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recvQueueLines bounds how many lines may wait between the reader and the
+// command loop; a client that fills it is flooding regardless of RecvQ.
+const recvQueueLines = 256
+
+var errExcessFlood = errors.New("excess flood")
+
+// commandCosts is how much of the flood allowance each command uses.
+// Commands that hit the database, fan out to many clients or check a
+// password cost more; anything not listed costs defaultCommandCost.
+var commandCosts = map[string]time.Duration{
+	"PING":         0,
+	"PONG":         0,
+	"CAP":          0,
+	"QUIT":         0,
+	"NICK":         3 * time.Second,
+	"JOIN":         2 * time.Second,
+	"LIST":         3 * time.Second,
+	"NAMES":        2 * time.Second,
+	"WHO":          2 * time.Second,
+	"WHOIS":        2 * time.Second,
+	"CHATHISTORY":  2 * time.Second,
+	"INVITE":       2 * time.Second,
+	"AUTHENTICATE": 2 * time.Second,
+	"OPER":         3 * time.Second,
+}
+
+const defaultCommandCost = time.Second
+
+// readLines reads the client's lines and hands them to the command loop.
+// Lines waiting longer than the command loop can keep up with count against
+// the RecvQ; a client that exceeds it is disconnected for Excess Flood. The
+// channel is closed when reading stops, with the reason in readErr.
+func (client *Client) readLines(reader *bufio.Reader, lines chan<- string) {
+	defer close(lines)
+	for {
+		client.conn.SetReadDeadline(time.Now().Add(config().Limits.ReadTimeout.Duration))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			client.readErr = err
+			return
+		}
+
+		if client.recvQBytes.Add(int64(len(line))) > int64(config().Limits.RecvQ) {
+			client.excessFlood()
+			return
+		}
+		select {
+		case lines <- line:
+		default:
+			client.excessFlood()
+			return
+		}
+	}
+}
+
+func (client *Client) excessFlood() {
+	log.Printf("Excess flood from %s, disconnecting", client.conn.RemoteAddr().String())
+	sendServerNotice('f', "Excess Flood from %s (%s@%s) [%s]", client.nickOrStar(), client.Username, client.Hostname, client.ip())
+	client.setQuitReason("Excess Flood")
+	client.readErr = errExcessFlood
+}
+
+// throttle charges a command against the client's flood allowance, a token
+// bucket kept as a virtual clock: each command moves the clock forward by
+// its cost, and once the clock is more than the burst ahead of real time
+// the client is made to wait ("fake lag") before the command runs. IRC
+// operators are exempt.
+func (client *Client) throttle(command string) {
+	if client.IsOperator {
+		return
+	}
+	cost, ok := commandCosts[command]
+	if !ok {
+		cost = defaultCommandCost
+	}
+
+	now := time.Now()
+	if client.floodClock.Before(now) {
+		client.floodClock = now
+	}
+	client.floodClock = client.floodClock.Add(cost)
+
+	if lag := client.floodClock.Sub(now) - config().Limits.FloodBurst.Duration; lag > 0 {
+		time.Sleep(lag)
+	}
+}
+
+// floodAction is what happens to someone who trips a channel's +f.
+type floodAction string
+
+const (
+	floodKick  floodAction = "kick"
+	floodQuiet floodAction = "quiet"
+)
+
+// floodQuietDuration is how long the quiet action silences a flooder.
+const floodQuietDuration = 10 * time.Minute
+
+// floodSetting is a parsed +f parameter, "lines:seconds[:action]".
+type floodSetting struct {
+	lines   int
+	seconds int
+	action  floodAction
+}
+
+func parseFloodSetting(param string) (floodSetting, error) {
+	parts := strings.Split(param, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return floodSetting{}, fmt.Errorf("flood setting must be lines:seconds[:kick|quiet]")
+	}
+	lines, err := strconv.Atoi(parts[0])
+	if err != nil || lines < 1 {
+		return floodSetting{}, fmt.Errorf("invalid line count %q", parts[0])
+	}
+	seconds, err := strconv.Atoi(parts[1])
+	if err != nil || seconds < 1 {
+		return floodSetting{}, fmt.Errorf("invalid number of seconds %q", parts[1])
+	}
+	setting := floodSetting{lines: lines, seconds: seconds, action: floodKick}
+	if len(parts) == 3 {
+		switch floodAction(strings.ToLower(parts[2])) {
+		case floodKick:
+		case floodQuiet:
+			setting.action = floodQuiet
+		default:
+			return floodSetting{}, fmt.Errorf("unknown flood action %q", parts[2])
+		}
+	}
+	return setting, nil
+}
+
+func (setting floodSetting) String() string {
+	s := fmt.Sprintf("%d:%d", setting.lines, setting.seconds)
+	if setting.action != floodKick {
+		s += ":" + string(setting.action)
+	}
+	return s
+}
+
+// checkFlood counts a message from the client against the channel's +f
+// and reports whether it tripped the limit. Halfops and above and IRC
+// operators are exempt.
+func (channel *Channel) checkFlood(client *Client) bool {
+	if channel.Flood == "" || client.IsOperator {
+		return false
+	}
+	setting, err := parseFloodSetting(channel.Flood)
+	if err != nil {
+		return false
+	}
+
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+	membership, ok := channel.members[client]
+	if !ok || membership.Modes.atLeast(memberHalfop) {
+		return false
+	}
+
+	now := time.Now()
+	if now.Sub(membership.floodStart) > time.Duration(setting.seconds)*time.Second {
+		membership.floodStart = now
+		membership.floodLines = 0
+	}
+	membership.floodLines++
+	if membership.floodLines <= setting.lines {
+		return false
+	}
+	membership.floodLines = 0
+	return true
+}
+
+// punishFlood applies the channel's +f action to a client that tripped it.
+func (channel *Channel) punishFlood(client *Client) {
+	setting, err := parseFloodSetting(channel.Flood)
+	if err != nil {
+		return
+	}
+	log.Printf("Client %s flooded %s, action %s", client.Nickname, channel.Name, setting.action)
+	sendServerNotice('f', "%s (%s@%s) flooded %s, action %s", client.Nickname, client.Username, client.Hostname, channel.Name, setting.action)
+
+	reason := fmt.Sprintf("Flooding (limit is %d lines in %d seconds)", setting.lines, setting.seconds)
+	switch setting.action {
+	case floodQuiet:
+		mask := normalizeMask(client.Nickname)
+		if ip := client.ip(); ip != nil {
+			mask = "*!*@" + ip.String()
+		}
+		added, err := channel.addListEntry('Q', mask, ServerNameString, time.Now().Add(floodQuietDuration))
+		if err != nil {
+			log.Printf("Error quieting %s on %s: %v", mask, channel.Name, err)
+			return
+		}
+		if added {
+			broadcastToChannel(channel, newRelayMessage(ServerNameString, "MODE", channel.Name, "+Q", mask))
+		}
+		client.sendNotice(ServerNameString, fmt.Sprintf("You have been quieted in %s for %s: %s", channel.Name, floodQuietDuration, reason))
+	default:
+		broadcastToChannel(channel, newRelayMessage(ServerNameString, "KICK", channel.Name, client.Nickname, reason))
+		removeClientFromChannel(client, channel)
+	}
+}
@@ -10,19 +10,52 @@ import (
 	"time"
 )
 
-func handlePrivmsg(client *Client, target string, message string) {
-	log.Printf("Handling PRIVMSG: target=%s, message=%s", target, message)
+func handlePrivmsg(client *Client, msg *Message) {
+	routeMessage(client, msg)
+}
+
+// handleNotice routes a NOTICE like a PRIVMSG. Per RFC 1459 a NOTICE never
+// triggers an automatic reply, so errors, services and bot commands stay
+// silent.
+func handleNotice(client *Client, msg *Message) {
+	routeMessage(client, msg)
+}
 
-	if strings.EqualFold(target, "ChanServ") {
-		log.Printf("ChanServ command received from %s: %s", client.Nickname, message)
-		ChanServ.HandleMessage(client, strings.TrimPrefix(message, ":"))
+// routeMessage delivers a PRIVMSG or NOTICE to a channel or user.
+func routeMessage(client *Client, msg *Message) {
+	command := msg.Command
+	notice := command == "NOTICE"
+	reply := func(numeric string, params ...string) {
+		if !notice {
+			client.sendNumeric(numeric, params...)
+		}
+	}
+
+	if len(msg.Params) < 1 {
+		reply(ERR_NORECIPIENT, fmt.Sprintf("No recipient given (%s)", command))
 		return
 	}
+	if len(msg.Params) < 2 || msg.Params[1] == "" {
+		reply(ERR_NOTEXTTOSEND, "No text to send")
+		return
+	}
+
+	target, message := msg.Params[0], msg.Params[1]
 
-	if strings.EqualFold(target, "NickServ") {
-		log.Printf("NickServ command received from %s: %s", client.Nickname, message)
-		handleNickServMessage(client, strings.TrimPrefix(message, ":"))
-		// Remove the acknowledgment message
+	tags, ok := client.clientTags(msg)
+	if !ok {
+		return
+	}
+
+	if isServiceNick(target) {
+		if notice {
+			return
+		}
+		if strings.EqualFold(target, "ChanServ") {
+			ChanServ.HandleMessage(client, message)
+		} else {
+			handleNickServMessage(client, message)
+		}
 		return
 	}
 
@@ -30,112 +63,146 @@ func handlePrivmsg(client *Client, target string, message string) {
 		channel := findChannel(target)
 		if channel != nil {
 			log.Printf("Message is for channel %s", channel.Name)
-			if handleBotCommands(client, channel, message) {
+			if !channel.canSend(client) {
+				reply(ERR_CANNOTSENDTOCHAN, channel.Name, "Cannot send to channel")
+				return
+			}
+			if channel.checkFlood(client) {
+				channel.punishFlood(client)
+				return
+			}
+			if !notice && handleBotCommands(client, channel, message) {
 				log.Printf("Bot command handled: %s", message)
 				return
 			}
-			broadcastMessage(channel, client, message)
+			relay := newRelayMessage(client.hostmask(), command, channel.Name, message).withTags(tags)
+			broadcastMessage(channel, client, relay)
+			recordHistory(channelKey(channel.Name), client, relay)
 		} else {
 			log.Printf("Channel not found: %s", target)
-			client.conn.Write([]byte(fmt.Sprintf(":%s 403 %s %s :No such channel\r\n", ServerNameString, client.Nickname, target)))
+			reply(ERR_NOSUCHCHANNEL, target, "No such channel")
 		}
 	} else {
 		targetClient := findClientByNickname(target)
 		if targetClient != nil {
-			targetClient.conn.Write([]byte(fmt.Sprintf(":%s PRIVMSG %s :%s\r\n", client.Nickname, target, message)))
+			relay := newRelayMessage(client.hostmask(), command, targetClient.Nickname, message).withTags(tags)
+			targetClient.send(relay)
+			if key, ok := directMessageKey(client, targetClient); ok {
+				recordHistory(key, client, relay)
+			}
 		} else {
-			client.conn.Write([]byte(fmt.Sprintf(":%s 401 %s %s :No such nick/channel\r\n", ServerNameString, client.Nickname, target)))
+			reply(ERR_NOSUCHNICK, target, "No such nick/channel")
 		}
 	}
 }
 
-func handleList(client *Client) {
-	log.Println("handleList: start")
-	channels, err := getAllChannels()
-	if err != nil {
-		log.Printf("Error getting channels: %v", err)
-		client.conn.Write([]byte(fmt.Sprintf(":%s 323 %s :Error listing channels\r\n", ServerNameString, client.Nickname)))
+// handleTagmsg relays a message that carries only tags, such as +typing or
+// +react. It only reaches clients that negotiated message-tags.
+func handleTagmsg(client *Client, msg *Message) {
+	if len(msg.Params) < 1 {
+		client.sendNumeric(ERR_NORECIPIENT, "No recipient given (TAGMSG)")
 		return
 	}
 
-	for _, channel := range channels {
-		userCount, err := getChannelUserCount(channel.ID)
-		if err != nil {
-			log.Printf("Error getting user count for channel %s: %v", channel.Name, err)
-			continue
-		}
-		client.conn.Write([]byte(fmt.Sprintf(":%s 322 %s %s %d :%s\r\n", ServerNameString, client.Nickname, channel.Name, userCount, channel.Topic)))
+	// Without message-tags the client can't have attached anything to relay
+	tags, ok := client.clientTags(msg)
+	if !ok || !client.hasCap(capMessageTags) {
+		return
 	}
-	client.conn.Write([]byte(fmt.Sprintf(":%s 323 %s :End of /LIST\r\n", ServerNameString, client.Nickname)))
-}
 
-func handleNames(client *Client, channelName string) {
-	log.Printf("handleNames: starting for channel: %s", channelName)
-	var users []string
-
-	if channelName == "" {
-		log.Println("handleNames: fetching all users")
-		// Get all users from the database
-		err := DB.Select(&users, "SELECT nickname FROM users")
-		if err != nil {
-			log.Printf("Error getting all users: %v", err)
-			client.conn.Write([]byte(fmt.Sprintf(":%s 366 %s * :Error listing users\r\n", ServerNameString, client.Nickname)))
+	target := msg.Params[0]
+	if strings.HasPrefix(target, "#") {
+		channel := findChannel(target)
+		if channel == nil {
+			client.sendNumeric(ERR_NOSUCHCHANNEL, target, "No such channel")
 			return
 		}
-	} else {
-		log.Printf("handleNames: fetching users for channel: %s", channelName)
-		channel := findChannel(channelName)
-		if channel != nil {
-			// Get users in the channel from the database
-			err := DB.Select(&users, `
-				SELECT u.nickname 
-				FROM users u 
-				JOIN user_channels uc ON u.id = uc.user_id 
-				WHERE uc.channel_id = ?
-			`, channel.ID)
-			if err != nil {
-				log.Printf("Error getting users for channel %s: %v", channelName, err)
-				client.conn.Write([]byte(fmt.Sprintf(":%s 366 %s %s :Error listing users\r\n", ServerNameString, client.Nickname, channelName)))
-				return
-			}
-		} else {
-			log.Printf("handleNames: channel not found: %s", channelName)
-			client.conn.Write([]byte(fmt.Sprintf(":%s 403 %s %s :No such channel\r\n", ServerNameString, client.Nickname, channelName)))
+		if !channel.canSend(client) {
+			client.sendNumeric(ERR_CANNOTSENDTOCHAN, channel.Name, "Cannot send to channel")
+			return
+		}
+		if channel.checkFlood(client) {
+			channel.punishFlood(client)
 			return
 		}
+		tagmsg := newRelayMessage(client.hostmask(), "TAGMSG", channel.Name).withTags(tags)
+		for _, c := range channel.clients() {
+			if c != client && c.hasCap(capMessageTags) {
+				c.send(tagmsg)
+			}
+		}
+		return
+	}
+
+	targetClient := findClientByNickname(target)
+	if targetClient == nil {
+		client.sendNumeric(ERR_NOSUCHNICK, target, "No such nick/channel")
+		return
+	}
+	if targetClient.hasCap(capMessageTags) {
+		targetClient.send(newRelayMessage(client.hostmask(), "TAGMSG", targetClient.Nickname).withTags(tags))
+	}
+}
+
+func handleList(client *Client, msg *Message) {
+	log.Println("handleList: start")
+	for _, channel := range allChannels() {
+		if !channel.isVisibleTo(client) {
+			continue
+		}
+		client.sendNumeric(RPL_LIST, channel.Name, strconv.Itoa(channel.memberCount()), channel.Topic)
 	}
+	client.sendNumeric(RPL_LISTEND, "End of /LIST")
+}
 
-	log.Printf("handleNames: found %d users", len(users))
-	userList := strings.Join(users, " ")
+func handleNames(client *Client, msg *Message) {
+	channelName := msg.Param(0)
+	log.Printf("handleNames: starting for channel: %s", channelName)
 
-	if channelName == "" {
+	if channelName == "" || channelName == "*" {
 		log.Println("handleNames: sending global user list")
-		client.conn.Write([]byte(fmt.Sprintf(":%s 353 %s * * :%s\r\n", ServerNameString, client.Nickname, userList)))
-		client.conn.Write([]byte(fmt.Sprintf(":%s 366 %s * :End of /NAMES list.\r\n", ServerNameString, client.Nickname)))
-	} else {
-		log.Printf("handleNames: sending user list for channel %s", channelName)
-		client.conn.Write([]byte(fmt.Sprintf(":%s 353 %s = %s :%s\r\n", ServerNameString, client.Nickname, channelName, userList)))
-		client.conn.Write([]byte(fmt.Sprintf(":%s 366 %s %s :End of /NAMES list.\r\n", ServerNameString, client.Nickname, channelName)))
+		var users []string
+		for _, c := range getAllVisibleClients(client) {
+			users = append(users, c.Nickname)
+		}
+		client.sendNumeric(RPL_NAMREPLY, "*", "*", strings.Join(users, " "))
+		client.sendNumeric(RPL_ENDOFNAMES, "*", "End of /NAMES list.")
+		return
+	}
+
+	// Hidden channels look empty from outside
+	channel := findChannel(channelName)
+	if channel == nil || !channel.isVisibleTo(client) {
+		log.Printf("handleNames: channel not found: %s", channelName)
+		client.sendNumeric(RPL_ENDOFNAMES, channelName, "End of /NAMES list.")
+		return
 	}
+
+	log.Printf("handleNames: sending user list for channel %s", channelName)
+	sendNamesListToClient(client, channel)
 	log.Println("handleNames: completed")
 }
 
-func handleJoin(client *Client, channelNames string) {
-	log.Printf("Handling JOIN command for client %s, channels: %s", client.Nickname, channelNames)
+func handleJoin(client *Client, msg *Message) {
+	if len(msg.Params) < 1 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "JOIN", "Not enough parameters")
+		return
+	}
+	log.Printf("Handling JOIN command for client %s, channels: %s", client.Nickname, msg.Params[0])
 
 	// Split the channel names and keys
-	parts := strings.SplitN(channelNames, " ", 2)
-	channelList := strings.Split(parts[0], ",")
+	channelList := strings.Split(msg.Params[0], ",")
 	keys := []string{}
-	if len(parts) > 1 {
-		keys = strings.Split(parts[1], ",")
+	if len(msg.Params) > 1 {
+		keys = strings.Split(msg.Params[1], ",")
 	}
 
 	log.Printf("Channels after split: %v, Keys: %v", channelList, keys)
 
-	// Validate and filter channel names
+	// Validate and filter channel names, keeping each one's key
 	var validChannels []string
-	for _, channelName := range channelList {
+	channelKeys := make(map[string]string)
+	for i, channelName := range channelList {
 		channelName = strings.TrimSpace(channelName)
 		if channelName == "" || strings.EqualFold(channelName, "na") {
 			log.Printf("Skipping invalid channel name: '%s'", channelName)
@@ -145,6 +212,9 @@ func handleJoin(client *Client, channelNames string) {
 			channelName = "#" + channelName
 		}
 		validChannels = append(validChannels, channelName)
+		if i < len(keys) {
+			channelKeys[channelName] = keys[i]
+		}
 	}
 
 	log.Printf("Valid channels: %v", validChannels)
@@ -156,51 +226,48 @@ func handleJoin(client *Client, channelNames string) {
 		channel, err := getOrCreateChannel(channelName)
 		if err != nil {
 			log.Printf("Error getting or creating channel %s: %v", channelName, err)
-			client.conn.Write([]byte(fmt.Sprintf(":%s 403 %s %s :Failed to join channel\r\n", ServerNameString, client.Nickname, channelName)))
+			client.sendNumeric(ERR_NOSUCHCHANNEL, channelName, "Failed to join channel")
 			continue
 		}
 
-		// Check if the client is already in the channel
-		isAlreadyInChannel, err := isClientInChannel(client, channel)
-		if err != nil {
-			log.Printf("Error checking if client is in channel: %v", err)
-			client.conn.Write([]byte(fmt.Sprintf(":%s 403 %s %s :Failed to join channel\r\n", ServerNameString, client.Nickname, channelName)))
+		// Joining a channel you're already in is a no-op
+		if channel.hasMember(client) {
+			log.Printf("Client %s is already in channel %s", client.Nickname, channelName)
 			continue
 		}
 
-		log.Printf("Is client already in channel: %v", isAlreadyInChannel)
+		if numeric, reason := channel.joinError(client, channelKeys[channelName]); numeric != "" {
+			log.Printf("Client %s may not join %s: %s", client.Nickname, channel.Name, reason)
+			client.sendNumeric(numeric, channel.Name, reason)
+			continue
+		}
 
-		if !isAlreadyInChannel {
-			// Add the client to the channel in the database
-			err = addClientToChannel(client, channel, false) // Set isOperator to false by default
-			if err != nil {
-				log.Printf("Error adding client %s to channel %s: %v", client.Nickname, channelName, err)
-				client.conn.Write([]byte(fmt.Sprintf(":%s 403 %s %s :Failed to join channel\r\n", ServerNameString, client.Nickname, channelName)))
-				continue
+		// Whoever creates an unregistered channel gets ops, and the founder
+		// gets founder status when joining their registered channel
+		var modes memberModes
+		if channel.IsRegistered {
+			if client.IsIdentified && channel.FounderID.Valid && channel.FounderID.Int64 == client.ID {
+				modes = memberFounder
 			}
-			log.Printf("Successfully added client %s to channel %s in the database", client.Nickname, channelName)
-
-			// Add the channel to the client's list of channels
-			client.Channels = append(client.Channels, channel)
-			log.Printf("Added channel %s to client %s's channel list", channelName, client.Nickname)
+		} else if channel.memberCount() == 0 {
+			modes = memberOp
 		}
 
-		// Send JOIN message to the joining client
-		joinMessage := fmt.Sprintf(":%s!%s@%s JOIN %s\r\n", client.Nickname, client.Username, client.Hostname, channelName)
-		client.conn.Write([]byte(joinMessage))
-		log.Printf("Sent JOIN message to client %s for channel %s", client.Nickname, channelName)
+		addClientToChannel(client, channel, modes)
+		channel.removeInvite(client)
+		log.Printf("Added client %s to channel %s", client.Nickname, channelName)
 
-		// Send JOIN message to all other clients in the channel
-		broadcastToChannel(channel, joinMessage)
+		// Send the JOIN message to everyone in the channel, including the joining client
+		broadcastToChannel(channel, newRelayMessage(client.hostmask(), "JOIN", channel.Name))
 		log.Printf("Broadcasted JOIN message to all clients in channel %s", channelName)
 
 		// Send the channel topic to the joining client
 		if channel.Topic != "" {
-			client.conn.Write([]byte(fmt.Sprintf(":%s 332 %s %s :%s\r\n", ServerNameString, client.Nickname, channelName, channel.Topic)))
-			client.conn.Write([]byte(fmt.Sprintf(":%s 333 %s %s %s %d\r\n", ServerNameString, client.Nickname, channelName, "Unknown", channel.CreatedAt.Unix())))
+			client.sendNumeric(RPL_TOPIC, channelName, channel.Topic)
+			client.sendNumeric(RPL_TOPICWHOTIME, channelName, "Unknown", strconv.FormatInt(channel.CreatedAt.Unix(), 10))
 			log.Printf("Sent channel topic to client %s for channel %s", client.Nickname, channelName)
 		} else {
-			client.conn.Write([]byte(fmt.Sprintf(":%s 331 %s %s :No topic is set\r\n", ServerNameString, client.Nickname, channelName)))
+			client.sendNumeric(RPL_NOTOPIC, channelName, "No topic is set")
 		}
 
 		// Send names list
@@ -209,43 +276,21 @@ func handleJoin(client *Client, channelNames string) {
 	}
 
 	log.Printf("Finished processing JOIN command for client %s", client.Nickname)
-	log.Printf("Client %s is now in channels: %v", client.Nickname, client.Channels)
 }
 
 // Helper function to broadcast a message to all clients in a channel
-func broadcastToChannel(channel *Channel, message string) {
-	log.Printf("Broadcasting to channel %s: %s", channel.Name, message)
-	channelClients, err := getClientsInChannel(channel)
-	if err != nil {
-		log.Printf("Error getting clients in channel %s: %v", channel.Name, err)
-		return
-	}
-	for _, c := range channelClients {
-		if c.conn != nil {
-			_, err := c.conn.Write([]byte(message))
-			if err != nil {
-				log.Printf("Error sending message to client %s: %v", c.Nickname, err)
-			}
-		}
+func broadcastToChannel(channel *Channel, msg *Message) {
+	log.Printf("Broadcasting to channel %s: %s", channel.Name, msg)
+	for _, c := range channel.clients() {
+		c.send(msg)
 	}
 }
 
 func sendNamesListToClient(client *Client, channel *Channel) {
-	channelClients, err := getClientsInChannel(channel)
-	if err != nil {
-		log.Printf("Error getting clients in channel %s: %v", channel.Name, err)
-		return
-	}
-
 	var nicknames []string
-	for _, c := range channelClients {
-		prefix := ""
-		if c.IsOperator {
-			prefix = "@"
-		} else if c.HasVoice {
-			prefix = "+"
-		}
-		nicknames = append(nicknames, prefix+c.Nickname)
+	for _, c := range channel.clients() {
+		modes, _ := channel.memberModes(c)
+		nicknames = append(nicknames, modes.prefixFor(client)+c.Nickname)
 	}
 
 	// Send names list in chunks of 10 nicknames
@@ -255,110 +300,69 @@ func sendNamesListToClient(client *Client, channel *Channel) {
 			end = len(nicknames)
 		}
 		chunk := nicknames[i:end]
-		nicknameList := strings.Join(chunk, " ")
-		client.conn.Write([]byte(fmt.Sprintf(":%s 353 %s = %s :%s\r\n", ServerNameString, client.Nickname, channel.Name, nicknameList)))
+		client.sendNumeric(RPL_NAMREPLY, channel.namesSymbol(), channel.Name, strings.Join(chunk, " "))
 	}
 
 	// Send end of names list
-	client.conn.Write([]byte(fmt.Sprintf(":%s 366 %s %s :End of /NAMES list.\r\n", ServerNameString, client.Nickname, channel.Name)))
-}
-
-func handleCap(client *Client, params string) {
-	log.Printf("Handling CAP command: %s", params)
-	parts := strings.SplitN(params, " ", 2)
-	if len(parts) > 1 {
-		subCommand := parts[0]
-		switch subCommand {
-		case "LS":
-			// Check if the client requested a specific CAP version
-			if len(parts) > 1 && strings.HasPrefix(parts[1], "302") {
-				client.conn.Write([]byte("CAP * LS * :multi-prefix\r\n"))
-			} else {
-				client.conn.Write([]byte("CAP * LS :multi-prefix\r\n"))
-			}
-			log.Printf("Sent CAP LS response to %s", client.conn.RemoteAddr().String())
-		case "REQ":
-			// Respond to capability requests. We support multi-prefix.
-			requestedCaps := strings.Split(parts[1], " ")
-			unsupportedCaps := make([]string, 0)
-			for _, cap := range requestedCaps {
-				if cap != "multi-prefix" {
-					unsupportedCaps = append(unsupportedCaps, cap)
-				}
-			}
-			if len(unsupportedCaps) > 0 {
-				client.conn.Write([]byte(fmt.Sprintf("CAP * NAK :%s\r\n", strings.Join(unsupportedCaps, " "))))
-			} else {
-				client.conn.Write([]byte(fmt.Sprintf("CAP * ACK :%s\r\n", parts[1])))
-			}
-		case "END":
-			// End of CAP negotiation.
-			client.conn.Write([]byte("CAP * END\r\n"))
-		case "LIST":
-			// List the capabilities currently enabled for the client. Since we support multi-prefix, respond with it.
-			client.conn.Write([]byte("CAP * LIST :multi-prefix\r\n"))
-		case "CLEAR":
-			// Clear all capabilities. Since we support multi-prefix, just acknowledge the command.
-			client.conn.Write([]byte("CAP * CLEAR :\r\n"))
-		default:
-			// Unknown subcommand, respond with an error.
-			client.conn.Write([]byte(fmt.Sprintf(":%s 410 %s :Invalid CAP subcommand\r\n", ServerNameString, client.Nickname)))
-		}
-	} else {
-		log.Printf("Invalid CAP command from %s: %s", client.conn.RemoteAddr().String(), params)
-		client.conn.Write([]byte(fmt.Sprintf(":%s 410 %s :Invalid CAP command\r\n", ServerNameString, client.Nickname)))
-	}
+	client.sendNumeric(RPL_ENDOFNAMES, channel.Name, "End of /NAMES list.")
 }
 
-func handlePart(client *Client, channelName string) {
-	channel := findChannel(channelName)
-	if channel == nil {
-		client.conn.Write([]byte(fmt.Sprintf(":%s 403 %s %s :No such channel\r\n", ServerNameString, client.Nickname, channelName)))
+func handlePart(client *Client, msg *Message) {
+	if len(msg.Params) < 1 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "PART", "Not enough parameters")
 		return
 	}
 
-	err := removeClientFromChannel(client, channel)
-	if err != nil {
-		log.Printf("Error removing client from channel: %v", err)
-	}
-
-	// Remove the channel from the client's list of channels
-	for i, ch := range client.Channels {
-		if ch.Name == channelName {
-			client.Channels = append(client.Channels[:i], client.Channels[i+1:]...)
-			break
+	for _, channelName := range strings.Split(msg.Params[0], ",") {
+		channel := findChannel(channelName)
+		if channel == nil {
+			client.sendNumeric(ERR_NOSUCHCHANNEL, channelName, "No such channel")
+			continue
 		}
-	}
 
-	partMessage := fmt.Sprintf(":%s!%s@%s PART %s\r\n", client.Nickname, client.Username, client.Hostname, channelName)
-	client.conn.Write([]byte(partMessage))
+		if !channel.hasMember(client) {
+			client.sendNumeric(ERR_NOTONCHANNEL, channelName, "You're not on that channel")
+			continue
+		}
 
-	// Notify other users in the channel
-	for _, c := range channel.Clients {
-		if c != client {
-			c.conn.Write([]byte(partMessage))
+		// Notify everyone in the channel, including the parting client
+		partMessage := newRelayMessage(client.hostmask(), "PART", channel.Name)
+		if len(msg.Params) > 1 {
+			partMessage.Params = append(partMessage.Params, msg.Params[1])
 		}
+		broadcastToChannel(channel, partMessage)
+
+		removeClientFromChannel(client, channel)
 	}
 }
 
 func handleQuit(client *Client, message string) {
-	quitMessage := fmt.Sprintf(":%s!%s@%s QUIT :%s\r\n", client.Nickname, client.Nickname, client.conn.RemoteAddr().String(), message)
+	quitMessage := newRelayMessage(client.hostmask(), "QUIT", message)
+	if client.ID != 0 {
+		sendServerNotice('c', "Client exiting: %s (%s@%s) [%s]", client.Nickname, client.Username, client.Hostname, message)
+	}
 
-	// Notify all channels the user was in
-	for _, channel := range client.Channels {
-		for _, c := range channel.Clients {
-			if c != client {
-				c.conn.Write([]byte(quitMessage))
-			}
-		}
+	// Notify everyone who shares a channel with the user, once each
+	for _, c := range channelPeers(client) {
+		c.send(quitMessage)
 	}
 
 	removeClient(client)
 	removeConnectedClient(client.Nickname)
-	client.conn.Close()
+
+	// The ERROR goes out ahead of the close; anything already queued for
+	// the client is flushed first.
+	client.send(newMessage("", "ERROR", fmt.Sprintf("Closing Link: %s (%s)", client.nickOrStar(), message)))
+	client.closeSendQueue()
 }
 
-func handleUser(client *Client, username, hostname, realname string) {
+func handleUser(client *Client, msg *Message) {
+	if len(msg.Params) < 4 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "USER", "Not enough parameters")
+		return
+	}
+
+	username, hostname, realname := msg.Params[0], msg.Params[1], msg.Params[3]
 	log.Printf("Handling USER command for %s: username=%s, hostname=%s, realname=%s", client.conn.RemoteAddr().String(), username, hostname, realname)
 
 	client.Username = username
@@ -367,21 +371,46 @@ func handleUser(client *Client, username, hostname, realname string) {
 
 	// Check if we have both NICK and USER info
 	if client.Nickname != "" {
-		completeRegistration(client)
+		tryCompleteRegistration(client)
 	} else {
 		// Send a message to guide the user
-		client.conn.Write([]byte(fmt.Sprintf(":%s NOTICE * :Welcome! Please set your nickname using the NICK command.\r\n", ServerNameString)))
+		client.sendNotice(ServerNameString, "Welcome! Please set your nickname using the NICK command.")
+	}
+}
+
+// tryCompleteRegistration registers the client once NICK and USER have both
+// arrived and any CAP negotiation has ended.
+func tryCompleteRegistration(client *Client) {
+	if client.ID != 0 || client.Nickname == "" || client.Username == "" || client.capNegotiating {
+		return
 	}
+	completeRegistration(client)
 }
 
 func completeRegistration(client *Client) {
+	if rejectBannedClient(client) {
+		return
+	}
+
 	// Check if the nickname already exists in the database
 	existingClient, err := getClientByNickname(client.Nickname)
+	if err == nil && existingClient != nil && existingClient.Password != "" && !client.IsIdentified && !strings.EqualFold(client.Account, existingClient.Nickname) {
+		// A registered nick picked during CAP negotiation without logging in
+		client.sendNumeric(ERR_NICKNAMEINUSE, client.Nickname, "Nickname is registered. Use /msg NickServ IDENTIFY password to use this nick.")
+		client.Nickname = ""
+		return
+	}
 	if err == nil && existingClient != nil {
 		// Nickname exists, update the existing record
 		client.ID = existingClient.ID
 		client.CreatedAt = existingClient.CreatedAt
 		client.LastSeen = time.Now()
+		// Logging in with SASL identifies the client for its account's nick
+		if client.Account != "" && strings.EqualFold(client.Account, existingClient.Nickname) {
+			client.Password = existingClient.Password
+			client.Email = existingClient.Email
+			client.IsIdentified = true
+		}
 		err = updateClientInfo(client)
 	} else {
 		// New nickname, create a new record
@@ -392,7 +421,7 @@ func completeRegistration(client *Client) {
 
 	if err != nil {
 		log.Printf("Error registering client: %v", err)
-		client.conn.Write([]byte(fmt.Sprintf(":%s 451 %s :Failed to register (database error)\r\n", ServerNameString, client.Nickname)))
+		client.sendNumeric(ERR_NOTREGISTERED, "Failed to register (database error)")
 		return
 	}
 
@@ -401,27 +430,43 @@ func completeRegistration(client *Client) {
 
 	// Add the client to the connected clients list
 	addConnectedClient(client)
+	sendServerNotice('c', "Client connecting: %s (%s@%s) [%s]", client.Nickname, client.Username, client.Hostname, client.ip())
 
 	// Send instructions to the user
-	client.conn.Write([]byte(fmt.Sprintf(":%s NOTICE %s :To register your nickname, use /msg NickServ REGISTER <password> <email>\r\n", ServerNameString, client.Nickname)))
-	client.conn.Write([]byte(fmt.Sprintf(":%s NOTICE %s :After registering, you can identify using /msg NickServ IDENTIFY <password>\r\n", ServerNameString, client.Nickname)))
+	client.sendNotice(ServerNameString, "To register your nickname, use /msg NickServ REGISTER <password> <email>")
+	client.sendNotice(ServerNameString, "After registering, you can identify using /msg NickServ IDENTIFY <password>")
 }
 
-func handleMode(client *Client, target string, modes string) {
+func handleMode(client *Client, msg *Message) {
+	if len(msg.Params) < 1 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "MODE", "Not enough parameters")
+		return
+	}
+
+	target := msg.Params[0]
 	if strings.HasPrefix(target, "#") {
-		handleChannelMode(client, target, modes)
+		handleChannelMode(client, target, msg.Params[1:])
 	} else {
-		handleUserMode(client, target, modes)
+		handleUserMode(client, target, msg.Params[1:])
 	}
 }
 
-func handleUserMode(client *Client, target string, modes string) {
-	if target != client.Nickname {
-		client.conn.Write([]byte(fmt.Sprintf(":%s 502 %s :Can't change mode for other users\r\n", ServerNameString, client.Nickname)))
+func handleUserMode(client *Client, target string, params []string) {
+	if casefold(target) != casefold(client.Nickname) {
+		client.sendNumeric(ERR_USERSDONTMATCH, "Can't change mode for other users")
+		return
+	}
+
+	if len(params) == 0 || params[0] == "" {
+		client.sendNumeric(RPL_UMODEIS, client.userModes())
 		return
 	}
 
+	modes, modeArgs := params[0], params[1:]
 	adding := true
+	argIndex := 0
+	var changes modeChanges
+	unknown := false
 	for _, mode := range modes {
 		switch mode {
 		case '+':
@@ -429,115 +474,207 @@ func handleUserMode(client *Client, target string, modes string) {
 		case '-':
 			adding = false
 		case 'i':
+			if client.Invisible == adding {
+				continue
+			}
 			client.Invisible = adding
-			_, err := DB.Exec("UPDATE users SET invisible = ? WHERE nickname = ?", adding, client.Nickname)
+			_, err := DB.Exec("UPDATE users SET invisible = ? WHERE id = ?", adding, client.ID)
 			if err != nil {
 				log.Printf("Error updating user invisible mode: %v", err)
 			}
+			changes.add(adding, mode)
+		case 'w':
+			if client.Wallops != adding {
+				client.Wallops = adding
+				changes.add(adding, mode)
+			}
+		case 's':
+			// +s takes an optional snomask change such as "+cx" or "-n";
+			// without one an operator subscribes to everything
+			if !adding {
+				if client.snomask != "" {
+					client.snomask = ""
+					changes.add(adding, mode)
+				}
+				continue
+			}
+			change := snomaskLetters()
+			if argIndex < len(modeArgs) {
+				change = modeArgs[argIndex]
+				argIndex++
+			} else if client.snomask != "" {
+				change = ""
+			}
+			if !client.IsOperator {
+				client.sendNumeric(ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+				continue
+			}
+			client.snomask = applySnomask(client.snomask, change)
+			if client.snomask != "" {
+				changes.add(adding, mode, "+"+client.snomask)
+				client.sendNumeric(RPL_SNOMASK, "+"+client.snomask, "Server notice mask")
+			}
 		case 'o':
-			// 'o' mode should only be set by the OPER command, not by MODE
+			// Only OPER grants +o, but operators may drop it
 			if adding {
-				client.conn.Write([]byte(fmt.Sprintf(":%s 481 %s :Permission Denied- You're not an IRC operator\r\n", ServerNameString, client.Nickname)))
+				if !client.IsOperator {
+					client.sendNumeric(ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+				}
+			} else if client.IsOperator {
+				client.deoper()
+				changes.add(adding, mode)
 			}
+		default:
+			unknown = true
 		}
 	}
+	if unknown {
+		client.sendNumeric(ERR_UMODEUNKNOWNFLAG, "Unknown MODE flag")
+	}
 
 	// Notify the user of their new modes
-	client.conn.Write([]byte(fmt.Sprintf(":%s MODE %s :%s\r\n", client.Nickname, client.Nickname, modes)))
+	if !changes.empty() {
+		client.send(newMessage(client.Nickname, "MODE", append([]string{client.Nickname, changes.modes.String()}, changes.args...)...))
+	}
 }
 
-func handleChannelMode(client *Client, channelName string, modes string) {
+// userModes is the client's user modes as a mode string, e.g. "+io".
+func (client *Client) userModes() string {
+	modes := "+"
+	if client.Invisible {
+		modes += "i"
+	}
+	if client.IsOperator {
+		modes += "o"
+	}
+	if client.snomask != "" {
+		modes += "s"
+	}
+	if client.Wallops {
+		modes += "w"
+	}
+	return modes
+}
+
+func handleChannelMode(client *Client, channelName string, params []string) {
 	channel := findChannel(channelName)
 	if channel == nil {
-		client.conn.Write([]byte(fmt.Sprintf(":%s 403 %s %s :No such channel\r\n", ServerNameString, client.Nickname, channelName)))
+		client.sendNumeric(ERR_NOSUCHCHANNEL, channelName, "No such channel")
 		return
 	}
 
-	// Check if the client is a channel operator
-	isOperator, err := isClientChannelOperator(client, channel)
-	if err != nil {
-		log.Printf("Error checking operator status: %v", err)
-		client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Internal server error\r\n", ServerNameString, client.Nickname)))
+	// If no modes are provided, list the current channel modes
+	if len(params) == 0 {
+		listChannelModes(client, channel)
 		return
 	}
 
-	if !isOperator {
-		client.conn.Write([]byte(fmt.Sprintf(":%s 482 %s %s :You're not channel operator\r\n", ServerNameString, client.Nickname, channelName)))
+	// List modes without a mask, e.g. "MODE #chan b", show the lists
+	if len(params) == 1 && isListQuery(params[0]) {
+		for _, mode := range strings.Trim(params[0], "+-") {
+			sendChannelList(client, channel, findListMode(mode))
+		}
 		return
 	}
 
-	// If no modes are provided, list the current channel modes
-	if modes == "" {
-		listChannelModes(client, channel)
+	// Halfops may set list modes and voice; everything else needs ops
+	modes, _ := channel.memberModes(client)
+	if !modes.atLeast(memberHalfop) {
+		client.sendNumeric(ERR_CHANOPRIVSNEEDED, channelName, "You're not channel operator")
 		return
 	}
 
-	modeArgs := strings.Fields(modes)
-	modeString := modeArgs[0]
-	modeArgs = modeArgs[1:]
+	modeString := params[0]
+	modeArgs := params[1:]
 	adding := true
 	argIndex := 0
+	var changes modeChanges
+	var newBans []string
 
 	for _, mode := range modeString {
-		switch mode {
-		case '+':
-			adding = true
-		case '-':
-			adding = false
-		case 'b':
-			if argIndex < len(modeArgs) {
-				mask := modeArgs[argIndex]
-				if adding {
-					err := addChannelBan(channel.ID, mask)
-					if err != nil {
-						log.Printf("Error adding channel ban: %v", err)
-						client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Error setting mode 'b'\r\n", ServerNameString, client.Nickname)))
-					} else {
-						banMessage := fmt.Sprintf(":%s!%s@%s MODE %s +b %s\r\n", client.Nickname, client.Username, client.Hostname, channelName, mask)
-						broadcastToChannel(channel, banMessage)
-						kickBannedUsers(channel, mask)
-					}
-				} else {
-					err := removeChannelBan(channel.ID, mask)
-					if err != nil {
-						log.Printf("Error removing channel ban: %v", err)
-						client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Error removing mode 'b'\r\n", ServerNameString, client.Nickname)))
-					} else {
-						unbanMessage := fmt.Sprintf(":%s!%s@%s MODE %s -b %s\r\n", client.Nickname, client.Username, client.Hostname, channelName, mask)
-						broadcastToChannel(channel, unbanMessage)
-					}
+		if mode == '+' || mode == '-' {
+			adding = mode == '+'
+			continue
+		}
+		if listMode := findListMode(mode); listMode != nil {
+			if argIndex >= len(modeArgs) {
+				sendChannelList(client, channel, listMode)
+				continue
+			}
+			mask, expires := splitTimedMask(modeArgs[argIndex])
+			mask = normalizeMask(mask)
+			argIndex++
+			if setListEntry(client, channel, listMode, adding, mask, expires) {
+				changes.add(adding, mode, mask)
+				if adding && mode == 'b' {
+					newBans = append(newBans, mask)
 				}
+			}
+			continue
+		}
+		if _, isPrefix := memberModeForLetter(mode); !isPrefix && !modes.atLeast(memberOp) {
+			client.sendNumeric(ERR_CHANOPRIVSNEEDED, channelName, "You're not channel operator")
+			// Skip the refused mode's parameter so the rest still line up
+			if adding && (mode == 'k' || mode == 'l' || mode == 'f') {
 				argIndex++
-			} else {
-				client.conn.Write([]byte(fmt.Sprintf(":%s 461 %s MODE :Not enough parameters\r\n", ServerNameString, client.Nickname)))
 			}
+			continue
+		}
+
+		switch mode {
 		case 'n':
 			channel.NoExternalMessages = adding
 			_, err := DB.Exec("UPDATE channels SET no_external_messages = ? WHERE name = ?", adding, channelName)
 			if err != nil {
 				log.Printf("Error updating channel no_external_messages mode: %v", err)
-				client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Error setting mode 'n'\r\n", ServerNameString, client.Nickname)))
+				client.sendNumeric(ERR_UNKNOWNERROR, "Error setting mode 'n'")
+			} else {
+				changes.add(adding, mode)
 			}
 		case 't':
 			channel.TopicProtection = adding
 			_, err := DB.Exec("UPDATE channels SET topic_protection = ? WHERE name = ?", adding, channelName)
 			if err != nil {
 				log.Printf("Error updating channel topic_protection mode: %v", err)
-				client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Error setting mode 't'\r\n", ServerNameString, client.Nickname)))
+				client.sendNumeric(ERR_UNKNOWNERROR, "Error setting mode 't'")
+			} else {
+				changes.add(adding, mode)
 			}
 		case 'm':
 			channel.Moderated = adding
 			_, err := DB.Exec("UPDATE channels SET moderated = ? WHERE name = ?", adding, channelName)
 			if err != nil {
 				log.Printf("Error updating channel moderated mode: %v", err)
-				client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Error setting mode 'm'\r\n", ServerNameString, client.Nickname)))
+				client.sendNumeric(ERR_UNKNOWNERROR, "Error setting mode 'm'")
+			} else {
+				changes.add(adding, mode)
 			}
 		case 'i':
 			channel.InviteOnly = adding
 			_, err := DB.Exec("UPDATE channels SET invite_only = ? WHERE name = ?", adding, channelName)
 			if err != nil {
 				log.Printf("Error updating channel invite_only mode: %v", err)
-				client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Error setting mode 'i'\r\n", ServerNameString, client.Nickname)))
+				client.sendNumeric(ERR_UNKNOWNERROR, "Error setting mode 'i'")
+			} else {
+				changes.add(adding, mode)
+			}
+		case 's':
+			channel.Secret = adding
+			_, err := DB.Exec("UPDATE channels SET secret = ? WHERE name = ?", adding, channelName)
+			if err != nil {
+				log.Printf("Error updating channel secret mode: %v", err)
+				client.sendNumeric(ERR_UNKNOWNERROR, "Error setting mode 's'")
+			} else {
+				changes.add(adding, mode)
+			}
+		case 'p':
+			channel.Private = adding
+			_, err := DB.Exec("UPDATE channels SET private = ? WHERE name = ?", adding, channelName)
+			if err != nil {
+				log.Printf("Error updating channel private mode: %v", err)
+				client.sendNumeric(ERR_UNKNOWNERROR, "Error setting mode 'p'")
+			} else {
+				changes.add(adding, mode)
 			}
 		case 'k':
 			if adding && argIndex < len(modeArgs) {
@@ -545,7 +682,9 @@ func handleChannelMode(client *Client, channelName string, modes string) {
 				_, err := DB.Exec("UPDATE channels SET key = ? WHERE name = ?", channel.Key.String, channelName)
 				if err != nil {
 					log.Printf("Error updating channel key: %v", err)
-					client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Error setting mode 'k'\r\n", ServerNameString, client.Nickname)))
+					client.sendNumeric(ERR_UNKNOWNERROR, "Error setting mode 'k'")
+				} else {
+					changes.add(adding, mode, channel.Key.String)
 				}
 				argIndex++
 			} else if !adding {
@@ -553,10 +692,12 @@ func handleChannelMode(client *Client, channelName string, modes string) {
 				_, err := DB.Exec("UPDATE channels SET key = NULL WHERE name = ?", channelName)
 				if err != nil {
 					log.Printf("Error removing channel key: %v", err)
-					client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Error removing mode 'k'\r\n", ServerNameString, client.Nickname)))
+					client.sendNumeric(ERR_UNKNOWNERROR, "Error removing mode 'k'")
+				} else {
+					changes.add(adding, mode)
 				}
 			} else {
-				client.conn.Write([]byte(fmt.Sprintf(":%s 461 %s MODE :Not enough parameters\r\n", ServerNameString, client.Nickname)))
+				client.sendNumeric(ERR_NEEDMOREPARAMS, "MODE", "Not enough parameters")
 			}
 		case 'l':
 			if adding && argIndex < len(modeArgs) {
@@ -566,10 +707,12 @@ func handleChannelMode(client *Client, channelName string, modes string) {
 					_, err := DB.Exec("UPDATE channels SET user_limit = ? WHERE name = ?", limit, channelName)
 					if err != nil {
 						log.Printf("Error updating channel user limit: %v", err)
-						client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Error setting mode 'l'\r\n", ServerNameString, client.Nickname)))
+						client.sendNumeric(ERR_UNKNOWNERROR, "Error setting mode 'l'")
+					} else {
+						changes.add(adding, mode, strconv.Itoa(limit))
 					}
 				} else {
-					client.conn.Write([]byte(fmt.Sprintf(":%s 461 %s MODE :Invalid user limit\r\n", ServerNameString, client.Nickname)))
+					client.sendNumeric(ERR_NEEDMOREPARAMS, "MODE", "Invalid user limit")
 				}
 				argIndex++
 			} else if !adding {
@@ -577,49 +720,125 @@ func handleChannelMode(client *Client, channelName string, modes string) {
 				_, err := DB.Exec("UPDATE channels SET user_limit = 0 WHERE name = ?", channelName)
 				if err != nil {
 					log.Printf("Error removing channel user limit: %v", err)
-					client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Error removing mode 'l'\r\n", ServerNameString, client.Nickname)))
+					client.sendNumeric(ERR_UNKNOWNERROR, "Error removing mode 'l'")
+				} else {
+					changes.add(adding, mode)
 				}
 			} else {
-				client.conn.Write([]byte(fmt.Sprintf(":%s 461 %s MODE :Not enough parameters\r\n", ServerNameString, client.Nickname)))
+				client.sendNumeric(ERR_NEEDMOREPARAMS, "MODE", "Not enough parameters")
 			}
-		case 'o', 'v':
-			if argIndex < len(modeArgs) {
-				targetNick := modeArgs[argIndex]
-				var targetClientID int
-				err := DB.QueryRow("SELECT id FROM users WHERE nickname = ?", targetNick).Scan(&targetClientID)
+		case 'f':
+			if adding && argIndex < len(modeArgs) {
+				setting, err := parseFloodSetting(modeArgs[argIndex])
+				argIndex++
 				if err != nil {
-					if err == sql.ErrNoRows {
-						client.conn.Write([]byte(fmt.Sprintf(":%s 401 %s %s :No such nick\r\n", ServerNameString, client.Nickname, targetNick)))
-					} else {
-						log.Printf("Error fetching user ID: %v", err)
-						client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Internal server error\r\n", ServerNameString, client.Nickname)))
-					}
+					client.sendNumeric(ERR_INVALIDMODEPARAM, channelName, "f", modeArgs[argIndex-1], err.Error())
+					continue
+				}
+				channel.Flood = setting.String()
+				_, err = DB.Exec("UPDATE channels SET flood = ? WHERE name = ?", channel.Flood, channelName)
+				if err != nil {
+					log.Printf("Error updating channel flood mode: %v", err)
+					client.sendNumeric(ERR_UNKNOWNERROR, "Error setting mode 'f'")
 				} else {
-					if mode == 'o' {
-						_, err := DB.Exec("UPDATE user_channels SET is_operator = ? WHERE user_id = ? AND channel_id = ?", adding, targetClientID, channel.ID)
-						if err != nil {
-							log.Printf("Error updating user channel operator status: %v", err)
-							client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Error setting mode 'o'\r\n", ServerNameString, client.Nickname)))
-						}
-					} else { // 'v'
-						_, err := DB.Exec("UPDATE user_channels SET has_voice = ? WHERE user_id = ? AND channel_id = ?", adding, targetClientID, channel.ID)
-						if err != nil {
-							log.Printf("Error updating user channel voice status: %v", err)
-							client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Error setting mode 'v'\r\n", ServerNameString, client.Nickname)))
-						}
-					}
+					changes.add(adding, mode, channel.Flood)
+				}
+			} else if !adding {
+				channel.Flood = ""
+				_, err := DB.Exec("UPDATE channels SET flood = '' WHERE name = ?", channelName)
+				if err != nil {
+					log.Printf("Error removing channel flood mode: %v", err)
+					client.sendNumeric(ERR_UNKNOWNERROR, "Error removing mode 'f'")
+				} else {
+					changes.add(adding, mode)
 				}
-				argIndex++
 			} else {
-				client.conn.Write([]byte(fmt.Sprintf(":%s 461 %s MODE :Not enough parameters\r\n", ServerNameString, client.Nickname)))
+				client.sendNumeric(ERR_NEEDMOREPARAMS, "MODE", "Not enough parameters")
+			}
+		case 'q', 'a', 'o', 'h', 'v':
+			if argIndex >= len(modeArgs) {
+				client.sendNumeric(ERR_NEEDMOREPARAMS, "MODE", "Not enough parameters")
+				continue
+			}
+			targetNick := modeArgs[argIndex]
+			argIndex++
+
+			targetClient := findClientByNickname(targetNick)
+			if targetClient == nil {
+				client.sendNumeric(ERR_NOSUCHNICK, targetNick, "No such nick")
+				continue
+			}
+			targetModes, isMember := channel.memberModes(targetClient)
+			if !isMember {
+				client.sendNumeric(ERR_USERNOTINCHANNEL, targetNick, channelName, "They aren't on that channel")
+				continue
+			}
+
+			// Members may always give up their own modes
+			prefixMode, _ := memberModeForLetter(mode)
+			selfRemoval := !adding && targetClient == client
+			if !selfRemoval && (!modes.canSetMemberMode(prefixMode) || (!adding && !modes.canActOn(targetModes))) {
+				client.sendNumeric(ERR_CHANOPRIVSNEEDED, channelName, fmt.Sprintf("You don't have enough channel privileges to set %c", mode))
+				continue
+			}
+			if (targetModes&prefixMode != 0) == adding {
+				continue
+			}
+			if channel.setMemberMode(targetClient, prefixMode, adding) {
+				changes.add(adding, mode, targetClient.Nickname)
 			}
 		default:
-			client.conn.Write([]byte(fmt.Sprintf(":%s 472 %s %c :is unknown mode char to me\r\n", ServerNameString, client.Nickname, mode)))
+			client.sendNumeric(ERR_UNKNOWNMODE, string(mode), "is unknown mode char to me")
 		}
 	}
 
-	// Notify all users in the channel about the mode change
-	notifyChannelModeChange(client, channel, modeString, modeArgs)
+	// Notify all users in the channel about the modes that were applied
+	if !changes.empty() {
+		notifyChannelModeChange(client, channel, changes.modes.String(), changes.args)
+	}
+	for _, mask := range newBans {
+		kickBannedUsers(channel, mask)
+	}
+}
+
+// isListQuery reports whether a mode string only names list modes, as in
+// "MODE #chan +b", which asks for the lists rather than changing them.
+func isListQuery(modeString string) bool {
+	letters := strings.Trim(modeString, "+-")
+	if letters == "" {
+		return false
+	}
+	for _, mode := range letters {
+		if findListMode(mode) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// modeChanges collects the channel modes a MODE command actually applied,
+// so refused or failed modes are not announced.
+type modeChanges struct {
+	modes  strings.Builder
+	args   []string
+	adding bool
+}
+
+func (c *modeChanges) add(adding bool, mode rune, args ...string) {
+	if c.modes.Len() == 0 || adding != c.adding {
+		if adding {
+			c.modes.WriteByte('+')
+		} else {
+			c.modes.WriteByte('-')
+		}
+		c.adding = adding
+	}
+	c.modes.WriteRune(mode)
+	c.args = append(c.args, args...)
+}
+
+func (c *modeChanges) empty() bool {
+	return c.modes.Len() == 0
 }
 
 func listChannelModes(client *Client, channel *Channel) {
@@ -638,6 +857,12 @@ func listChannelModes(client *Client, channel *Channel) {
 	if channel.InviteOnly {
 		modeString += "i"
 	}
+	if channel.Private {
+		modeString += "p"
+	}
+	if channel.Secret {
+		modeString += "s"
+	}
 	if channel.Key.Valid && channel.Key.String != "" {
 		modeString += "k"
 		modeArgs = append(modeArgs, channel.Key.String)
@@ -646,178 +871,131 @@ func listChannelModes(client *Client, channel *Channel) {
 		modeString += "l"
 		modeArgs = append(modeArgs, strconv.Itoa(channel.UserLimit))
 	}
-
-	if modeString != "" {
-		modeString = "+" + modeString
+	if channel.Flood != "" {
+		modeString += "f"
+		modeArgs = append(modeArgs, channel.Flood)
 	}
 
-	client.conn.Write([]byte(fmt.Sprintf(":%s 324 %s %s %s %s\r\n", ServerNameString, client.Nickname, channel.Name, modeString, strings.Join(modeArgs, " "))))
+	modeString = "+" + modeString
+
+	client.sendNumeric(RPL_CHANNELMODEIS, append([]string{channel.Name, modeString}, modeArgs...)...)
 }
 
 func notifyChannelModeChange(client *Client, channel *Channel, modeString string, modeArgs []string) {
-	rows, err := DB.Query("SELECT u.nickname FROM users u JOIN user_channels uc ON u.id = uc.user_id WHERE uc.channel_id = ?", channel.ID)
-	if err != nil {
-		log.Printf("Error fetching channel users: %v", err)
+	broadcastToChannel(channel, newRelayMessage(client.hostmask(), "MODE", append([]string{channel.Name, modeString}, modeArgs...)...))
+}
+
+func handleTopic(client *Client, msg *Message) {
+	if len(msg.Params) < 1 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "TOPIC", "Not enough parameters")
 		return
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var nickname string
-		if err := rows.Scan(&nickname); err != nil {
-			log.Printf("Error scanning user nickname: %v", err)
-			continue
-		}
-		targetClient := findClientByNickname(nickname)
-		if targetClient != nil {
-			targetClient.conn.Write([]byte(fmt.Sprintf(":%s MODE %s %s %s\r\n", client.Nickname, channel.Name, modeString, strings.Join(modeArgs, " "))))
-		}
-	}
-}
-
-func handleTopic(client *Client, channelName string, newTopic string) {
-	log.Printf("handleTopic: starting for channel: %s, new topic: %s", channelName, newTopic)
+	channelName := msg.Params[0]
+	log.Printf("handleTopic: starting for channel: %s, params: %v", channelName, msg.Params[1:])
 	channel := findChannel(channelName)
 	if channel == nil {
 		log.Printf("handleTopic: channel not found: %s", channelName)
-		client.conn.Write([]byte(fmt.Sprintf(":%s 403 %s %s :No such channel\r\n", ServerNameString, client.Nickname, channelName)))
+		client.sendNumeric(ERR_NOSUCHCHANNEL, channelName, "No such channel")
 		return
 	}
 
 	// Check if the client is in the channel
-	var isOperator bool
-	err := DB.QueryRow("SELECT is_operator FROM user_channels WHERE user_id = ? AND channel_id = ?", client.ID, channel.ID).Scan(&isOperator)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("handleTopic: client %s is not in channel %s", client.Nickname, channelName)
-			client.conn.Write([]byte(fmt.Sprintf(":%s 442 %s %s :You're not on that channel\r\n", ServerNameString, client.Nickname, channelName)))
-			return
-		}
-		log.Printf("handleTopic: error checking client channel status: %v", err)
-		client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Internal server error\r\n", ServerNameString, client.Nickname)))
+	modes, isMember := channel.memberModes(client)
+	if !isMember {
+		log.Printf("handleTopic: client %s is not in channel %s", client.Nickname, channelName)
+		client.sendNumeric(ERR_NOTONCHANNEL, channelName, "You're not on that channel")
 		return
 	}
+	canChangeTopic := modes.atLeast(memberHalfop)
 
-	if newTopic == "" {
+	if len(msg.Params) < 2 {
 		// Send current topic
-		client.conn.Write([]byte(fmt.Sprintf(":%s 332 %s %s :%s\r\n", ServerNameString, client.Nickname, channelName, channel.Topic)))
-		client.conn.Write([]byte(fmt.Sprintf(":%s 333 %s %s %s %d\r\n", ServerNameString, client.Nickname, channelName, "Unknown", time.Now().Unix())))
+		client.sendNumeric(RPL_TOPIC, channelName, channel.Topic)
+		client.sendNumeric(RPL_TOPICWHOTIME, channelName, "Unknown", strconv.FormatInt(time.Now().Unix(), 10))
 		return
 	}
+	newTopic := msg.Params[1]
 
 	// Check if the client has permission to change the topic
-	if channel.TopicProtection && !isOperator {
+	if channel.TopicProtection && !canChangeTopic {
 		log.Printf("handleTopic: client %s doesn't have permission to change topic in %s", client.Nickname, channelName)
-		client.conn.Write([]byte(fmt.Sprintf(":%s 482 %s %s :You're not channel operator\r\n", ServerNameString, client.Nickname, channelName)))
+		client.sendNumeric(ERR_CHANOPRIVSNEEDED, channelName, "You're not channel operator")
 		return
 	}
 
 	// Set new topic
-	_, err = DB.Exec("UPDATE channels SET topic = ? WHERE id = ?", newTopic, channel.ID)
+	_, err := DB.Exec("UPDATE channels SET topic = ? WHERE id = ?", newTopic, channel.ID)
 	if err != nil {
 		log.Printf("handleTopic: error updating topic: %v", err)
-		client.conn.Write([]byte(fmt.Sprintf(":%s 500 %s :Internal server error\r\n", ServerNameString, client.Nickname)))
+		client.sendNumeric(ERR_UNKNOWNERROR, "Internal server error")
 		return
 	}
 
 	// Update the channel object
 	channel.Topic = newTopic
 
-	// Prepare the topic change messages
-	topicChangeMessage := fmt.Sprintf(":%s!%s@%s TOPIC %s :%s\r\n", client.Nickname, client.Username, client.Hostname, channelName, newTopic)
-
 	// Broadcast the topic change to all users in the channel
-	rows, err := DB.Query("SELECT u.nickname FROM users u JOIN user_channels uc ON u.id = uc.user_id WHERE uc.channel_id = ?", channel.ID)
-	if err != nil {
-		log.Printf("handleTopic: error fetching channel users: %v", err)
-		return
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var nickname string
-		if err := rows.Scan(&nickname); err != nil {
-			log.Printf("handleTopic: error scanning user nickname: %v", err)
-			continue
-		}
-		targetClient := findClientByNickname(nickname)
-		if targetClient != nil && targetClient.conn != nil {
-			log.Printf("handleTopic: sending topic change to %s", nickname)
-			targetClient.conn.Write([]byte(topicChangeMessage))
-			targetClient.conn.Write([]byte(fmt.Sprintf(":%s 332 %s %s :%s\r\n", ServerNameString, targetClient.Nickname, channelName, newTopic)))
-			targetClient.conn.Write([]byte(fmt.Sprintf(":%s 333 %s %s %s %d\r\n", ServerNameString, targetClient.Nickname, channelName, client.Nickname, time.Now().Unix())))
-		}
-	}
+	broadcastToChannel(channel, newRelayMessage(client.hostmask(), "TOPIC", channel.Name, newTopic))
 
 	log.Printf("handleTopic: topic updated successfully for channel %s", channelName)
 }
 
-func findChannel(name string) *Channel {
-	log.Printf("findChannel: searching for channel: %s", name)
-	var channel Channel
-	err := DB.Get(&channel, "SELECT * FROM channels WHERE name = ?", name)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("findChannel: channel not found: %s", name)
-		} else {
-			log.Printf("findChannel: error querying database: %v", err)
-		}
-		return nil
-	}
-	log.Printf("findChannel: found channel: %s", name)
-	return &channel
-}
-
-// Add these new functions to the handlers.go file
-
-func handleWho(client *Client, target string) {
+func handleWho(client *Client, msg *Message) {
+	target := msg.Param(0)
 	log.Printf("Handling WHO command for target: %s", target)
 
-	var users []*Client
-	var err error
-
 	if strings.HasPrefix(target, "#") {
 		// WHO for a channel
-		channel, err := getChannel(target)
-		if err != nil {
-			log.Printf("Error getting channel %s: %v", target, err)
+		channel := findChannel(target)
+		if channel == nil {
+			log.Printf("Channel not found: %s", target)
 			client.sendNumeric(ERR_NOSUCHCHANNEL, target, "No such channel")
 			return
 		}
-		users, err = getClientsInChannel(channel)
-		if err != nil {
-			log.Printf("Error getting clients in channel %s: %v", target, err)
-			client.sendNumeric(ERR_UNKNOWNERROR, "Error processing WHO command")
+		if !channel.isVisibleTo(client) {
+			client.sendNumeric(RPL_ENDOFWHO, target, "End of WHO list")
 			return
 		}
-	} else if target == "" {
+		for _, user := range channel.clients() {
+			sendWhoReply(client, user, channel)
+		}
+		client.sendNumeric(RPL_ENDOFWHO, target, "End of WHO list")
+		return
+	}
+
+	var users []*Client
+	if target == "" {
 		// WHO for all visible users
-		users, err = getAllVisibleClients()
+		users = getAllVisibleClients(client)
 	} else {
 		// WHO for a specific user or mask
-		users, err = getClientsByMask(target)
-	}
-
-	if err != nil {
-		log.Printf("Error processing WHO command: %v", err)
-		client.sendNumeric(ERR_UNKNOWNERROR, "Error processing WHO command")
-		return
+		users = getClientsByMask(target)
 	}
 
 	for _, user := range users {
-		sendWhoReply(client, user, target)
+		sendWhoReply(client, user, nil)
 	}
 
 	client.sendNumeric(RPL_ENDOFWHO, target, "End of WHO list")
 }
 
-func sendWhoReply(client *Client, target *Client, channelName string) {
+// sendWhoReply sends one RPL_WHOREPLY. channel may be nil when the WHO was
+// not for a channel.
+func sendWhoReply(client *Client, target *Client, channel *Channel) {
 	flags := "H" // Here
+	if target.Invisible {
+		flags = "G" // Gone (invisible)
+	}
 	if target.IsOperator {
 		flags += "*"
 	}
-	if target.Invisible {
-		flags = "G" // Gone (invisible)
+
+	channelName := "*"
+	if channel != nil {
+		channelName = channel.Name
+		modes, _ := channel.memberModes(target)
+		flags += modes.prefixFor(client)
 	}
 
 	client.sendNumeric(RPL_WHOREPLY,
@@ -830,12 +1008,20 @@ func sendWhoReply(client *Client, target *Client, channelName string) {
 		fmt.Sprintf("0 %s", target.Realname))
 }
 
-func handleWhois(client *Client, target string) {
+func handleWhois(client *Client, msg *Message) {
+	if len(msg.Params) < 1 {
+		client.sendNumeric(ERR_NONICKNAMEGIVEN, "No nickname given")
+		return
+	}
+
+	// WHOIS [server] <nick>: the nickname is always the last parameter
+	target := msg.Params[len(msg.Params)-1]
 	log.Printf("Handling WHOIS command for target: %s", target)
 
-	targetClient, err := getClientByNickname(target)
-	if err != nil {
+	targetClient := findClientByNickname(target)
+	if targetClient == nil {
 		client.sendNumeric(ERR_NOSUCHNICK, target, "No such nick/channel")
+		client.sendNumeric(RPL_ENDOFWHOIS, target, "End of WHOIS list")
 		return
 	}
 
@@ -843,18 +1029,16 @@ func handleWhois(client *Client, target string) {
 	client.sendNumeric(RPL_WHOISUSER, targetClient.Nickname, targetClient.Username, targetClient.Hostname, "*", targetClient.Realname)
 
 	// Send channels the user is in
-	channels, err := getChannelsForUser(targetClient)
-	if err == nil && len(channels) > 0 {
-		var channelList []string
-		for _, channel := range channels {
-			prefix := ""
-			if isChannelOperator(targetClient, channel) {
-				prefix = "@"
-			} else if hasChannelVoice(targetClient, channel) {
-				prefix = "+"
-			}
-			channelList = append(channelList, prefix+channel.Name)
+	var channelList []string
+	seeInvisible := client.hasOperPrivilege(privSeeInvisible)
+	for _, channel := range targetClient.channelList() {
+		if !channel.isVisibleTo(client) && !seeInvisible {
+			continue
 		}
+		modes, _ := channel.memberModes(targetClient)
+		channelList = append(channelList, modes.prefixFor(client)+channel.Name)
+	}
+	if len(channelList) > 0 {
 		client.sendNumeric(RPL_WHOISCHANNELS, targetClient.Nickname, strings.Join(channelList, " "))
 	}
 
@@ -865,6 +1049,9 @@ func handleWhois(client *Client, target string) {
 	if targetClient.IsOperator {
 		client.sendNumeric(RPL_WHOISOPERATOR, targetClient.Nickname, "is an IRC operator")
 	}
+	if targetClient.IsSecure {
+		client.sendNumeric(RPL_WHOISSECURE, targetClient.Nickname, "is using a secure connection")
+	}
 
 	// Fix: Convert seconds to int64
 	idleSeconds := int64(time.Since(targetClient.LastSeen).Seconds())
@@ -876,75 +1063,70 @@ func handleWhois(client *Client, target string) {
 
 // Add these helper functions
 
-func getAllVisibleClients() ([]*Client, error) {
+// getAllVisibleClients returns the connected clients that aren't +i, or
+// every client for operators with the see-invisible privilege.
+func getAllVisibleClients(viewer *Client) []*Client {
+	seeInvisible := viewer.hasOperPrivilege(privSeeInvisible)
 	var clients []*Client
-	err := DB.Select(&clients, "SELECT * FROM users WHERE invisible = 0")
-	return clients, err
+	for _, c := range connectedClientList() {
+		if !c.Invisible || seeInvisible {
+			clients = append(clients, c)
+		}
+	}
+	return clients
 }
 
-func getClientsByMask(mask string) ([]*Client, error) {
-	mask = strings.ReplaceAll(mask, "*", "%")
+// getClientsByMask returns the connected clients matching a WHO mask. A
+// mask with ! or @ is matched as nick!user@host; otherwise it may match the
+// nickname, username, hostname or realname.
+func getClientsByMask(mask string) []*Client {
+	fullMask := strings.ContainsAny(mask, "!@")
 	var clients []*Client
-	query := `
-		SELECT id, nickname, username, 
-			   COALESCE(hostname, '') as hostname, 
-			   COALESCE(realname, '') as realname, 
-			   COALESCE(password, '') as password, 
-			   invisible, is_operator, has_voice, created_at, 
-			   is_identified, last_seen, 
-			   COALESCE(email, '') as email
-		FROM users 
-		WHERE nickname LIKE ? OR username LIKE ? OR hostname LIKE ?
-	`
-	err := DB.Select(&clients, query, mask, mask, mask)
-	return clients, err
-}
-
-func getChannelsForUser(client *Client) ([]*Channel, error) {
-	var channels []*Channel
-	err := DB.Select(&channels, `
-		SELECT c.* 
-		FROM channels c
-		JOIN user_channels uc ON c.id = uc.channel_id
-		WHERE uc.user_id = ?
-	`, client.ID)
-	return channels, err
-}
-
-func isChannelOperator(client *Client, channel *Channel) bool {
-	var isOperator bool
-	err := DB.QueryRow("SELECT is_operator FROM user_channels WHERE user_id = ? AND channel_id = ?", client.ID, channel.ID).Scan(&isOperator)
-	return err == nil && isOperator
+	for _, c := range connectedClientList() {
+		var matched bool
+		if fullMask {
+			matched = c.matchesMask(mask)
+		} else {
+			matched = globMatch(mask, c.Nickname) || globMatch(mask, c.Username) ||
+				globMatch(mask, c.Hostname) || globMatch(mask, c.Realname)
+		}
+		if matched {
+			clients = append(clients, c)
+		}
+	}
+	return clients
 }
 
-func hasChannelVoice(client *Client, channel *Channel) bool {
-	var hasVoice bool
-	err := DB.QueryRow("SELECT has_voice FROM user_channels WHERE user_id = ? AND channel_id = ?", client.ID, channel.ID).Scan(&hasVoice)
-	return err == nil && hasVoice
-}
+func handleNick(client *Client, msg *Message) {
+	nickname := sanitizeString(msg.Param(0))
+	if nickname == "" {
+		client.sendNumeric(ERR_NONICKNAMEGIVEN, "No nickname given")
+		return
+	}
 
-func handleNick(client *Client, nickname string) {
 	log.Printf("Handling NICK command for %s, new nickname: %s", client.conn.RemoteAddr().String(), nickname)
-	if len(nickname) > 50 {
+	if len(nickname) > config().Limits.NickLength {
 		log.Printf("Nickname too long: %s", nickname)
-		client.conn.Write([]byte(fmt.Sprintf(":%s 432 * %s :Erroneous nickname\r\n", ServerNameString, nickname)))
+		client.sendNumeric(ERR_ERRONEUSNICKNAME, nickname, "Erroneous nickname")
 		return
 	}
 
 	// Check if the nickname is already in use by an online user
 	existingOnlineClient := findClientByNickname(nickname)
 	if existingOnlineClient != nil && existingOnlineClient != client {
-		client.conn.Write([]byte(fmt.Sprintf(":%s 433 * %s :Nickname is already in use\r\n", ServerNameString, nickname)))
+		client.sendNumeric(ERR_NICKNAMEINUSE, nickname, "Nickname is already in use")
 		return
 	}
 
-	// Check if the nickname is registered
+	// Check if the nickname is registered. During CAP negotiation the client
+	// may still log in with SASL, so the check waits for registration.
 	existingRegisteredClient, err := getClientByNickname(nickname)
-	if err == nil && existingRegisteredClient != nil && existingRegisteredClient.Password != "" {
+	if err == nil && existingRegisteredClient != nil && existingRegisteredClient.Password != "" && !client.capNegotiating {
 		// Nickname is registered
-		if !client.IsIdentified || client.Nickname != nickname {
+		loggedIn := strings.EqualFold(client.Account, nickname)
+		if !loggedIn && (!client.IsIdentified || client.Nickname != nickname) {
 			// Client is not identified for this nickname
-			client.conn.Write([]byte(fmt.Sprintf(":%s 433 * %s :Nickname is registered. Use /msg NickServ IDENTIFY password to use this nick.\r\n", ServerNameString, nickname)))
+			client.sendNumeric(ERR_NICKNAMEINUSE, nickname, "Nickname is registered. Use /msg NickServ IDENTIFY password to use this nick.")
 			return
 		}
 	}
@@ -961,43 +1143,45 @@ func handleNick(client *Client, nickname string) {
 		if err != nil {
 			log.Printf("Error updating client nickname in database: %v", err)
 			client.Nickname = oldNickname
-			client.conn.Write([]byte(fmt.Sprintf(":%s 432 %s :Nickname change failed\r\n", ServerNameString, nickname)))
+			client.sendNumeric(ERR_ERRONEUSNICKNAME, nickname, "Nickname change failed")
 			return
 		}
 	}
 
 	// Notify the client and other users about the nickname change
-	client.conn.Write([]byte(fmt.Sprintf(":%s NICK %s\r\n", oldNickname, nickname)))
+	client.send(newMessage(oldNickname, "NICK", nickname))
 	notifyNicknameChange(client, oldNickname, nickname)
+	if client.ID != 0 {
+		sendServerNotice('n', "Nick change: From %s to %s [%s@%s]", oldNickname, nickname, client.Username, client.Hostname)
+	}
 
 	// Check if we have both NICK and USER info
-	if client.Username != "" && client.ID == 0 {
-		completeRegistration(client)
+	if client.Username != "" {
+		tryCompleteRegistration(client)
 	}
 }
 
-func handleKick(client *Client, params string) {
-	parts := strings.SplitN(params, " ", 3)
-	if len(parts) < 2 {
+func handleKick(client *Client, msg *Message) {
+	if len(msg.Params) < 2 {
 		client.sendNumeric(ERR_NEEDMOREPARAMS, "KICK", "Not enough parameters")
 		return
 	}
 
-	channelName, targetNick := parts[0], parts[1]
-	reason := ""
-	if len(parts) > 2 {
-		reason = parts[2]
+	channelName, targetNick := msg.Params[0], msg.Params[1]
+	reason := targetNick
+	if len(msg.Params) > 2 {
+		reason = msg.Params[2]
 	}
 
-	channel, err := getChannel(channelName)
-	if err != nil {
+	channel := findChannel(channelName)
+	if channel == nil {
 		client.sendNumeric(ERR_NOSUCHCHANNEL, channelName, "No such channel")
 		return
 	}
 
-	// Check if the client is an operator in the channel
-	isOperator, err := isClientChannelOperator(client, channel)
-	if err != nil || !isOperator {
+	// Halfops and above may kick
+	modes, _ := channel.memberModes(client)
+	if !modes.atLeast(memberHalfop) {
 		client.sendNumeric(ERR_CHANOPRIVSNEEDED, channelName, "You're not channel operator")
 		return
 	}
@@ -1009,171 +1193,201 @@ func handleKick(client *Client, params string) {
 	}
 
 	// Check if the target is in the channel
-	inChannel, err := isClientInChannel(targetClient, channel)
-	if err != nil || !inChannel {
+	targetModes, isMember := channel.memberModes(targetClient)
+	if !isMember {
 		client.sendNumeric(ERR_USERNOTINCHANNEL, targetNick, channelName, "They aren't on that channel")
 		return
 	}
+	if !modes.canActOn(targetModes) {
+		client.sendNumeric(ERR_CHANOPRIVSNEEDED, channelName, "You can't kick someone of equal or higher rank")
+		return
+	}
 
-	// Perform the kick
-	err = removeClientFromChannel(targetClient, channel)
-	if err != nil {
-		log.Printf("Error kicking user from channel: %v", err)
-		client.sendNumeric(ERR_UNKNOWNERROR, "KICK", "Error kicking user")
+	// Announce the kick to everyone, including the target, then remove them
+	broadcastToChannel(channel, newRelayMessage(client.hostmask(), "KICK", channel.Name, targetClient.Nickname, reason))
+	removeClientFromChannel(targetClient, channel)
+}
+
+// handleInvite invites a user to a channel. With no parameters it lists the
+// client's pending invites instead.
+func handleInvite(client *Client, msg *Message) {
+	if len(msg.Params) == 0 {
+		for _, channel := range invitedChannels(client) {
+			client.sendNumeric(RPL_INVITELIST, channel.Name)
+		}
+		client.sendNumeric(RPL_ENDOFINVITELIST, "End of /INVITE list")
+		return
+	}
+	if len(msg.Params) < 2 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "INVITE", "Not enough parameters")
+		return
+	}
+
+	targetNick, channelName := msg.Params[0], msg.Params[1]
+
+	target := findClientByNickname(targetNick)
+	if target == nil {
+		client.sendNumeric(ERR_NOSUCHNICK, targetNick, "No such nick/channel")
 		return
 	}
 
-	kickMessage := fmt.Sprintf(":%s!%s@%s KICK %s %s :%s\r\n", client.Nickname, client.Username, client.Hostname, channelName, targetNick, reason)
-	broadcastToChannel(channel, kickMessage)
-	targetClient.conn.Write([]byte(kickMessage))
+	channel := findChannel(channelName)
+	if channel == nil {
+		client.sendNumeric(ERR_NOSUCHCHANNEL, channelName, "No such channel")
+		return
+	}
+	if !channel.hasMember(client) {
+		client.sendNumeric(ERR_NOTONCHANNEL, channel.Name, "You're not on that channel")
+		return
+	}
+	// Anyone in the channel may invite unless it is +i
+	if channel.InviteOnly && !channel.hasPrivilege(client, memberHalfop) {
+		client.sendNumeric(ERR_CHANOPRIVSNEEDED, channel.Name, "You're not channel operator")
+		return
+	}
+	if channel.hasMember(target) {
+		client.sendNumeric(ERR_USERONCHANNEL, target.Nickname, channel.Name, "is already on channel")
+		return
+	}
+
+	channel.addInvite(target)
+	log.Printf("Client %s invited %s to %s", client.Nickname, target.Nickname, channel.Name)
+
+	inviteMessage := newRelayMessage(client.hostmask(), "INVITE", target.Nickname, channel.Name)
+	client.sendNumeric(RPL_INVITING, target.Nickname, channel.Name)
+	target.send(inviteMessage)
+
+	// invite-notify tells the other members who could have sent the
+	// invite themselves
+	for _, member := range channel.clients() {
+		if member == client || !member.hasCap(capInviteNotify) {
+			continue
+		}
+		if channel.InviteOnly && !channel.hasPrivilege(member, memberHalfop) {
+			continue
+		}
+		member.send(inviteMessage)
+	}
 }
 
-func handleBan(client *Client, params string) {
-	parts := strings.SplitN(params, " ", 2)
-	if len(parts) < 2 {
+func handleBan(client *Client, msg *Message) {
+	if len(msg.Params) < 2 {
 		client.sendNumeric(ERR_NEEDMOREPARAMS, "BAN", "Not enough parameters")
 		return
 	}
 
-	channelName, mask := parts[0], parts[1]
+	// BAN <#channel> <mask> [duration]
+	channelName, mask := msg.Params[0], normalizeMask(msg.Params[1])
+	var expires time.Time
+	if len(msg.Params) > 2 {
+		duration, err := parseListDuration(msg.Params[2])
+		if err != nil {
+			client.sendNotice(ServerNameString, "Invalid ban duration; use e.g. 30m, 12h or 7d")
+			return
+		}
+		expires = time.Now().Add(duration)
+	}
 
-	channel, err := getChannel(channelName)
-	if err != nil {
+	channel := findChannel(channelName)
+	if channel == nil {
 		client.sendNumeric(ERR_NOSUCHCHANNEL, channelName, "No such channel")
 		return
 	}
 
-	// Check if the client is an operator in the channel
-	isOperator, err := isClientChannelOperator(client, channel)
-	if err != nil || !isOperator {
+	// Halfops and above may set bans
+	if !channel.hasPrivilege(client, memberHalfop) {
 		client.sendNumeric(ERR_CHANOPRIVSNEEDED, channelName, "You're not channel operator")
 		return
 	}
 
 	// Add the ban
-	err = addChannelBan(channel.ID, mask)
-	if err != nil {
-		log.Printf("Error adding channel ban: %v", err)
-		client.sendNumeric(ERR_UNKNOWNERROR, "BAN", "Error adding ban")
+	if !setListEntry(client, channel, findListMode('b'), true, mask, expires) {
 		return
 	}
 
-	banMessage := fmt.Sprintf(":%s!%s@%s MODE %s +b %s\r\n", client.Nickname, client.Username, client.Hostname, channelName, mask)
-	broadcastToChannel(channel, banMessage)
+	broadcastToChannel(channel, newRelayMessage(client.hostmask(), "MODE", channel.Name, "+b", mask))
 
 	// Kick banned users
 	kickBannedUsers(channel, mask)
 }
 
-func handleUnban(client *Client, params string) {
-	parts := strings.SplitN(params, " ", 2)
-	if len(parts) < 2 {
+func handleUnban(client *Client, msg *Message) {
+	if len(msg.Params) < 2 {
 		client.sendNumeric(ERR_NEEDMOREPARAMS, "UNBAN", "Not enough parameters")
 		return
 	}
 
-	channelName, mask := parts[0], parts[1]
+	channelName, mask := msg.Params[0], normalizeMask(msg.Params[1])
 
-	channel, err := getChannel(channelName)
-	if err != nil {
+	channel := findChannel(channelName)
+	if channel == nil {
 		client.sendNumeric(ERR_NOSUCHCHANNEL, channelName, "No such channel")
 		return
 	}
 
-	// Check if the client is an operator in the channel
-	isOperator, err := isClientChannelOperator(client, channel)
-	if err != nil || !isOperator {
+	// Halfops and above may set bans
+	if !channel.hasPrivilege(client, memberHalfop) {
 		client.sendNumeric(ERR_CHANOPRIVSNEEDED, channelName, "You're not channel operator")
 		return
 	}
 
 	// Remove the ban
-	err = removeChannelBan(channel.ID, mask)
-	if err != nil {
-		log.Printf("Error removing channel ban: %v", err)
-		client.sendNumeric(ERR_UNKNOWNERROR, "UNBAN", "Error removing ban")
+	if !setListEntry(client, channel, findListMode('b'), false, mask, time.Time{}) {
 		return
 	}
 
-	unbanMessage := fmt.Sprintf(":%s!%s@%s MODE %s -b %s\r\n", client.Nickname, client.Username, client.Hostname, channelName, mask)
-	broadcastToChannel(channel, unbanMessage)
+	broadcastToChannel(channel, newRelayMessage(client.hostmask(), "MODE", channel.Name, "-b", mask))
 }
 
-// Add this new function to kick banned users
+// kickBannedUsers removes members matching a new ban, unless an exception
+// covers them. Halfops and above are left alone so a broad ban can't kick
+// the people managing the channel.
 func kickBannedUsers(channel *Channel, banMask string) {
-	clients, err := getClientsInChannel(channel)
-	if err != nil {
-		log.Printf("Error getting clients in channel: %v", err)
-		return
-	}
-
-	for _, client := range clients {
-		if matchesBanMask(client, banMask) {
+	for _, client := range channel.clients() {
+		if channel.hasPrivilege(client, memberHalfop) {
+			continue
+		}
+		if matchesBanMask(client, banMask) && !channel.matchesList(client, 'e') {
+			broadcastToChannel(channel, newMessage(ServerNameString, "KICK", channel.Name, client.Nickname, "Banned"))
 			removeClientFromChannel(client, channel)
-			kickMessage := fmt.Sprintf(":%s KICK %s %s :Banned\r\n", ServerNameString, channel.Name, client.Nickname)
-			broadcastToChannel(channel, kickMessage)
-			client.conn.Write([]byte(kickMessage))
 		}
 	}
 }
 
-// Add this helper function to check if a client matches a ban mask
+// matchesBanMask reports whether the client matches an entry on one of a
+// channel's lists, either a hostmask or an extended ban.
 func matchesBanMask(client *Client, mask string) bool {
-	fullIdentifier := client.Nickname + "!" + client.Username + "@" + client.Hostname
-	return wildcardMatch(mask, fullIdentifier)
-}
-
-// Add this helper function for wildcard matching
-func wildcardMatch(pattern, str string) bool {
-	if pattern == "*" {
-		return true
+	if isExtban(mask) {
+		ban, err := parseExtban(mask)
+		return err == nil && ban.matches(client)
 	}
-	return strings.Contains(str, strings.ReplaceAll(pattern, "*", ""))
+	return client.matchesMask(mask)
 }
 
-func handleBanList(client *Client, params string) {
-	channelName := strings.TrimSpace(params)
+func handleBanList(client *Client, msg *Message) {
+	channelName := msg.Param(0)
 	if channelName == "" {
 		client.sendNumeric(ERR_NEEDMOREPARAMS, "BANLIST", "Not enough parameters")
 		return
 	}
 
-	channel, err := getChannel(channelName)
-	if err != nil {
+	channel := findChannel(channelName)
+	if channel == nil {
 		client.sendNumeric(ERR_NOSUCHCHANNEL, channelName, "No such channel")
 		return
 	}
 
 	// Check if the client is in the channel
-	inChannel, err := isClientInChannel(client, channel)
-	if err != nil {
-		log.Printf("Error checking if client is in channel: %v", err)
-		client.sendNumeric(ERR_UNKNOWNERROR, "BANLIST", "Error processing command")
-		return
-	}
-	if !inChannel {
+	if !channel.hasMember(client) {
 		client.sendNumeric(ERR_NOTONCHANNEL, channelName, "You're not on that channel")
 		return
 	}
 
-	bans, err := getChannelBans(channel.ID)
-	if err != nil {
-		log.Printf("Error getting channel bans: %v", err)
-		client.sendNumeric(ERR_UNKNOWNERROR, "BANLIST", "Error processing command")
-		return
-	}
-
-	for _, ban := range bans {
-		client.sendNumeric(RPL_BANLIST, channelName, ban)
-	}
-
-	client.sendNumeric(RPL_ENDOFBANLIST, channelName, "End of channel ban list")
+	sendChannelList(client, channel, findListMode('b'))
 }
 
 func handleBotCommands(client *Client, channel *Channel, message string) bool {
 	log.Printf("Checking for bot command: %s", message)
-	// Remove the leading colon if present
-	message = strings.TrimPrefix(message, ":")
 	if strings.HasPrefix(message, "!") {
 		parts := strings.Fields(message)
 		command := strings.ToLower(strings.TrimPrefix(parts[0], "!"))
@@ -1204,10 +1418,7 @@ func handleBotCommands(client *Client, channel *Channel, message string) bool {
 		if response != "" {
 			log.Printf("Bot response: %s", response)
 			// Send the response directly to the channel
-			responseMsg := fmt.Sprintf(":%s PRIVMSG %s : %s\r\n", "BotServ", channel.Name, response)
-			broadcastToChannel(channel, responseMsg)
-			// Also send to the client who issued the command
-			client.conn.Write([]byte(responseMsg))
+			broadcastToChannel(channel, newRelayMessage("BotServ", "PRIVMSG", channel.Name, response))
 		}
 		return true
 	}
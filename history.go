@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyEntry is a stored PRIVMSG or NOTICE. Target is the channel key for
+// channel messages and the conversation key for direct messages.
+type historyEntry struct {
+	ID        int64  `db:"id"`
+	Target    string `db:"target"`
+	MsgID     string `db:"msgid"`
+	SentAt    int64  `db:"sent_at"`
+	Sender    string `db:"sender"`
+	Source    string `db:"source"`
+	Recipient string `db:"recipient"`
+	Command   string `db:"command"`
+	Text      string `db:"message"`
+	Tags      string `db:"tags"`
+}
+
+func historyEnabled() bool {
+	return config().History.Enabled
+}
+
+// historyAccount is the user ID a client's direct message history is kept
+// under: the account it logged in to with SASL or NickServ, or 0 if it
+// hasn't. Nicknames can't be used, since anyone may take an unregistered
+// one.
+func (client *Client) historyAccount() int64 {
+	return client.AccountID
+}
+
+// conversationKey is the history key for direct messages between two
+// accounts, the same whichever of them sent the message.
+func conversationKey(a, b int64) string {
+	if b < a {
+		a, b = b, a
+	}
+	return fmt.Sprintf("dm:%d:%d", a, b)
+}
+
+// directMessageKey returns the history key for a direct message between
+// two clients. Only conversations between logged in clients are kept.
+func directMessageKey(sender, recipient *Client) (string, bool) {
+	a, b := sender.historyAccount(), recipient.historyAccount()
+	if a == 0 || b == 0 {
+		return "", false
+	}
+	return conversationKey(a, b), true
+}
+
+// recordHistory stores a relayed message under key. Only client-only tags
+// are kept; time and msgid have their own columns.
+func recordHistory(key string, sender *Client, msg *Message) {
+	if !historyEnabled() {
+		return
+	}
+
+	sentAt, err := time.Parse(serverTimeFormat, msg.Tags["time"])
+	if err != nil {
+		sentAt = time.Now()
+	}
+	clientTags := make(map[string]string)
+	for tag, value := range msg.Tags {
+		if strings.HasPrefix(tag, "+") {
+			clientTags[tag] = value
+		}
+	}
+
+	_, err = DB.Exec(`
+		INSERT INTO message_history (target, msgid, sent_at, sender, source, recipient, command, message, tags)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, key, msg.Tags["msgid"], sentAt.UnixMilli(), sender.Nickname, msg.Source, msg.Param(0), msg.Command, msg.Param(1), formatTags(clientTags))
+	if err != nil {
+		log.Printf("Error storing history for %s: %v", key, err)
+	}
+}
+
+// message rebuilds the entry as it was originally relayed.
+func (e *historyEntry) message() *Message {
+	msg := newMessage(e.Source, e.Command, e.Recipient, e.Text)
+	msg.Tags = parseTags(e.Tags)
+	msg.Tags["time"] = time.UnixMilli(e.SentAt).UTC().Format(serverTimeFormat)
+	msg.Tags["msgid"] = e.MsgID
+	return msg
+}
+
+// pruneHistory applies the retention policy. It runs from the maintenance
+// ticker in main.
+func pruneHistory() {
+	if !historyEnabled() {
+		return
+	}
+
+	history := config().History
+	if history.Retention.Duration > 0 {
+		cutoff := time.Now().Add(-history.Retention.Duration).UnixMilli()
+		result, err := DB.Exec("DELETE FROM message_history WHERE sent_at < ?", cutoff)
+		if err != nil {
+			log.Printf("Error pruning expired history: %v", err)
+		} else if n, _ := result.RowsAffected(); n > 0 {
+			log.Printf("Pruned %d expired history messages", n)
+		}
+	}
+
+	if history.MaxMessages > 0 {
+		result, err := DB.Exec(`
+			DELETE FROM message_history WHERE id IN (
+				SELECT id FROM (
+					SELECT id, ROW_NUMBER() OVER (PARTITION BY target ORDER BY sent_at DESC, id DESC) AS position
+					FROM message_history
+				) WHERE position > ?
+			)
+		`, history.MaxMessages)
+		if err != nil {
+			log.Printf("Error pruning history over the per-target limit: %v", err)
+		} else if n, _ := result.RowsAffected(); n > 0 {
+			log.Printf("Pruned %d history messages over the per-target limit", n)
+		}
+	}
+}
+
+// historyRef is a CHATHISTORY reference: either a timestamp, or a stored
+// message found by msgid, in which case id is set too.
+type historyRef struct {
+	sentAt int64
+	id     int64
+}
+
+// before reports whether r sorts before other.
+func (r historyRef) before(other historyRef) bool {
+	return r.sentAt < other.sentAt || r.sentAt == other.sentAt && r.id < other.id
+}
+
+// historyBound is one side of a range, compared on (sent_at, id).
+type historyBound struct {
+	sentAt int64
+	id     int64
+}
+
+// lowerBound selects entries after ref, and ref itself when inclusive.
+func (r historyRef) lowerBound(inclusive bool) *historyBound {
+	switch {
+	case r.id == 0 && inclusive:
+		return &historyBound{r.sentAt, 0}
+	case r.id == 0:
+		return &historyBound{r.sentAt, math.MaxInt64}
+	case inclusive:
+		return &historyBound{r.sentAt, r.id - 1}
+	}
+	return &historyBound{r.sentAt, r.id}
+}
+
+// upperBound selects entries before ref, and ref itself when inclusive.
+func (r historyRef) upperBound(inclusive bool) *historyBound {
+	switch {
+	case r.id == 0 && inclusive:
+		return &historyBound{r.sentAt, math.MaxInt64}
+	case r.id == 0:
+		return &historyBound{r.sentAt, 0}
+	case inclusive:
+		return &historyBound{r.sentAt, r.id + 1}
+	}
+	return &historyBound{r.sentAt, r.id}
+}
+
+// historyQuery selects up to limit entries for one target between two
+// optional bounds. With newest set the latest entries are picked instead
+// of the earliest; either way they are returned oldest first.
+type historyQuery struct {
+	key    string
+	after  *historyBound
+	before *historyBound
+	newest bool
+	limit  int
+}
+
+func (q historyQuery) run() ([]historyEntry, error) {
+	if q.limit <= 0 {
+		return nil, nil
+	}
+
+	query := "SELECT * FROM message_history WHERE target = ?"
+	args := []interface{}{q.key}
+	if q.after != nil {
+		query += " AND (sent_at > ? OR (sent_at = ? AND id > ?))"
+		args = append(args, q.after.sentAt, q.after.sentAt, q.after.id)
+	}
+	if q.before != nil {
+		query += " AND (sent_at < ? OR (sent_at = ? AND id < ?))"
+		args = append(args, q.before.sentAt, q.before.sentAt, q.before.id)
+	}
+	if q.newest {
+		query += " ORDER BY sent_at DESC, id DESC"
+	} else {
+		query += " ORDER BY sent_at ASC, id ASC"
+	}
+	query += " LIMIT ?"
+	args = append(args, q.limit)
+
+	var entries []historyEntry
+	if err := DB.Select(&entries, query, args...); err != nil {
+		return nil, err
+	}
+	if q.newest {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	return entries, nil
+}
+
+// handleChathistory implements the IRCv3 draft/chathistory command.
+func handleChathistory(client *Client, msg *Message) {
+	if !historyEnabled() {
+		client.sendNumeric(ERR_UNKNOWNCOMMAND, "CHATHISTORY", "Unknown command")
+		return
+	}
+	if len(msg.Params) < 1 {
+		failChathistory(client, "NEED_MORE_PARAMS", "Missing parameters")
+		return
+	}
+
+	subCommand := strings.ToUpper(msg.Params[0])
+	needed := 4
+	switch subCommand {
+	case "LATEST", "BEFORE", "AFTER", "AROUND", "TARGETS":
+	case "BETWEEN":
+		needed = 5
+	default:
+		failChathistory(client, "INVALID_PARAMS", "Unknown subcommand", subCommand)
+		return
+	}
+	if len(msg.Params) < needed {
+		failChathistory(client, "NEED_MORE_PARAMS", "Missing parameters", subCommand)
+		return
+	}
+
+	limit, err := strconv.Atoi(msg.Params[needed-1])
+	if err != nil || limit <= 0 {
+		failChathistory(client, "INVALID_PARAMS", "Invalid limit", subCommand, msg.Params[needed-1])
+		return
+	}
+	limit = min(limit, config().History.QueryLimit)
+
+	if subCommand == "TARGETS" {
+		handleChathistoryTargets(client, msg.Params[1], msg.Params[2], limit)
+		return
+	}
+
+	target := msg.Params[1]
+	key, ok := historyKey(client, target)
+	if !ok {
+		failChathistory(client, "INVALID_TARGET", "Messages could not be retrieved", subCommand, target)
+		return
+	}
+
+	var refs []*historyRef
+	for _, raw := range msg.Params[2 : needed-1] {
+		if raw == "*" && subCommand == "LATEST" {
+			refs = append(refs, nil)
+			continue
+		}
+		ref, found, err := parseHistoryRef(key, raw)
+		if err != nil {
+			failChathistory(client, "INVALID_PARAMS", "Invalid message reference", subCommand, raw)
+			return
+		}
+		if !found {
+			// An unknown msgid has nothing around it
+			sendHistoryBatch(client, target, nil)
+			return
+		}
+		refs = append(refs, ref)
+	}
+
+	var entries []historyEntry
+	switch subCommand {
+	case "LATEST":
+		q := historyQuery{key: key, newest: true, limit: limit}
+		if refs[0] != nil {
+			q.after = refs[0].lowerBound(false)
+		}
+		entries, err = q.run()
+	case "BEFORE":
+		entries, err = historyQuery{key: key, before: refs[0].upperBound(false), newest: true, limit: limit}.run()
+	case "AFTER":
+		entries, err = historyQuery{key: key, after: refs[0].lowerBound(false), limit: limit}.run()
+	case "AROUND":
+		entries, err = historyQuery{key: key, before: refs[0].upperBound(false), newest: true, limit: limit / 2}.run()
+		if err == nil {
+			var later []historyEntry
+			later, err = historyQuery{key: key, after: refs[0].lowerBound(true), limit: limit - len(entries)}.run()
+			entries = append(entries, later...)
+		}
+	case "BETWEEN":
+		start, end := refs[0], refs[1]
+		if end.before(*start) {
+			// Counting backwards from start picks the newest entries
+			entries, err = historyQuery{key: key, after: end.lowerBound(false), before: start.upperBound(false), newest: true, limit: limit}.run()
+		} else {
+			entries, err = historyQuery{key: key, after: start.lowerBound(false), before: end.upperBound(false), limit: limit}.run()
+		}
+	}
+	if err != nil {
+		log.Printf("Error reading history for %s: %v", key, err)
+		failChathistory(client, "MESSAGE_ERROR", "Messages could not be retrieved", subCommand, target)
+		return
+	}
+
+	sendHistoryBatch(client, target, entries)
+}
+
+// historyKey returns the history key for a CHATHISTORY target. Clients can
+// only read channels they are in and, once logged in, their own
+// conversations.
+func historyKey(client *Client, target string) (string, bool) {
+	if strings.HasPrefix(target, "#") {
+		channel := findChannel(target)
+		if channel == nil || !channel.hasMember(client) {
+			return "", false
+		}
+		return channelKey(channel.Name), true
+	}
+	account := client.historyAccount()
+	if account == 0 || target == "" || target == "*" {
+		return "", false
+	}
+	if other := findClientByNickname(target); other != nil && other.historyAccount() != 0 {
+		return conversationKey(account, other.historyAccount()), true
+	}
+	// Someone offline is found by their registered nickname
+	other, err := getClientByNickname(target)
+	if err != nil || other.Password == "" {
+		return "", false
+	}
+	return conversationKey(account, other.ID), true
+}
+
+// parseHistoryRef parses "timestamp=..." or "msgid=...". found is false for
+// a msgid that isn't stored under key.
+func parseHistoryRef(key, raw string) (ref *historyRef, found bool, err error) {
+	if value, ok := strings.CutPrefix(raw, "msgid="); ok {
+		var entry historyEntry
+		if err := DB.Get(&entry, "SELECT * FROM message_history WHERE target = ? AND msgid = ?", key, value); err != nil {
+			return nil, false, nil
+		}
+		return &historyRef{sentAt: entry.SentAt, id: entry.ID}, true, nil
+	}
+	ref, err = parseHistoryTimestamp(raw)
+	return ref, err == nil, err
+}
+
+func parseHistoryTimestamp(raw string) (*historyRef, error) {
+	value, ok := strings.CutPrefix(raw, "timestamp=")
+	if !ok {
+		return nil, fmt.Errorf("unknown message reference %q", raw)
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil, err
+	}
+	return &historyRef{sentAt: t.UnixMilli()}, nil
+}
+
+// handleChathistoryTargets lists the channels and conversations with
+// messages between two timestamps, least recently active first.
+func handleChathistoryTargets(client *Client, from, to string, limit int) {
+	start, errStart := parseHistoryTimestamp(from)
+	end, errEnd := parseHistoryTimestamp(to)
+	if errStart != nil || errEnd != nil {
+		failChathistory(client, "INVALID_PARAMS", "Timestamps are required", "TARGETS")
+		return
+	}
+	if end.before(*start) {
+		start, end = end, start
+	}
+
+	var conditions []string
+	var args []interface{}
+	account := client.historyAccount()
+	if account != 0 {
+		conditions = append(conditions, "target LIKE ?", "target LIKE ?")
+		args = append(args, fmt.Sprintf("dm:%d:%%", account), fmt.Sprintf("dm:%%:%d", account))
+	}
+	for _, channel := range client.channelList() {
+		conditions = append(conditions, "target = ?")
+		args = append(args, channelKey(channel.Name))
+	}
+	if len(conditions) == 0 {
+		sendBatch(client, "draft/chathistory-targets", nil, nil)
+		return
+	}
+
+	query := `
+		SELECT target, MAX(sent_at) AS sent_at, recipient
+		FROM message_history
+		WHERE sent_at > ? AND sent_at < ? AND (` + strings.Join(conditions, " OR ") + `)
+		GROUP BY target ORDER BY sent_at ASC LIMIT ?`
+	args = append([]interface{}{start.sentAt, end.sentAt}, args...)
+	args = append(args, limit)
+
+	// SQLite fills the bare columns from the row holding MAX(sent_at)
+	var rows []historyEntry
+	if err := DB.Select(&rows, query, args...); err != nil {
+		log.Printf("Error listing history targets for %s: %v", client.Nickname, err)
+		failChathistory(client, "MESSAGE_ERROR", "Targets could not be retrieved", "TARGETS")
+		return
+	}
+
+	var lines []*Message
+	for _, row := range rows {
+		name := row.Recipient
+		var a, b int64
+		if _, err := fmt.Sscanf(row.Target, "dm:%d:%d", &a, &b); err == nil {
+			// Conversations are listed under the other account's nickname
+			other := a
+			if a == account {
+				other = b
+			}
+			if name, err = getNicknameByID(other); err != nil {
+				continue
+			}
+		}
+		timestamp := time.UnixMilli(row.SentAt).UTC().Format(serverTimeFormat)
+		lines = append(lines, newMessage(ServerNameString, "CHATHISTORY", "TARGETS", name, timestamp))
+	}
+	sendBatch(client, "draft/chathistory-targets", nil, lines)
+}
+
+func sendHistoryBatch(client *Client, target string, entries []historyEntry) {
+	lines := make([]*Message, len(entries))
+	for i := range entries {
+		lines[i] = entries[i].message()
+	}
+	sendBatch(client, "chathistory", []string{target}, lines)
+}
+
+// sendBatch sends lines wrapped in a BATCH, or unwrapped to clients that
+// didn't negotiate batch.
+func sendBatch(client *Client, batchType string, params []string, lines []*Message) {
+	if !client.hasCap(capBatch) {
+		for _, line := range lines {
+			client.send(line)
+		}
+		return
+	}
+
+	id := newMsgID()[:12]
+	client.send(newMessage(ServerNameString, "BATCH", append([]string{"+" + id, batchType}, params...)...))
+	for _, line := range lines {
+		client.send(line.withTags(map[string]string{"batch": id}))
+	}
+	client.send(newMessage(ServerNameString, "BATCH", "-"+id))
+}
+
+// failChathistory sends a FAIL standard reply for CHATHISTORY.
+func failChathistory(client *Client, code, description string, context ...string) {
+	params := append([]string{"CHATHISTORY", code}, context...)
+	client.send(newMessage(ServerNameString, "FAIL", append(params, description)...))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxListEntries caps each of a channel's mask lists.
+const maxListEntries = 100
+
+// listMode is a channel mode that holds a list of masks rather than a flag
+// or a single value.
+type listMode struct {
+	letter rune
+	name   string
+	// listNumeric and endNumeric are the replies used to show the list.
+	listNumeric string
+	endNumeric  string
+	// private lists are only shown to halfops and above.
+	private bool
+}
+
+// listModes are the channel's mask lists: bans keep users out and silence
+// them, exceptions override bans and quiets, invite exceptions get past +i
+// and quiets only silence.
+var listModes = []listMode{
+	{letter: 'b', name: "ban", listNumeric: RPL_BANLIST, endNumeric: RPL_ENDOFBANLIST},
+	{letter: 'e', name: "exception", listNumeric: RPL_EXCEPTLIST, endNumeric: RPL_ENDOFEXCEPTLIST, private: true},
+	{letter: 'I', name: "invite exception", listNumeric: RPL_INVEXLIST, endNumeric: RPL_ENDOFINVEXLIST, private: true},
+	{letter: 'Q', name: "quiet", listNumeric: RPL_QUIETLIST, endNumeric: RPL_ENDOFQUIETLIST},
+}
+
+func findListMode(letter rune) *listMode {
+	for i := range listModes {
+		if listModes[i].letter == letter {
+			return &listModes[i]
+		}
+	}
+	return nil
+}
+
+// listModeLetters is the list modes as a string, e.g. "beIQ", for ISUPPORT.
+func listModeLetters() string {
+	letters := make([]rune, len(listModes))
+	for i, mode := range listModes {
+		letters[i] = mode.letter
+	}
+	return string(letters)
+}
+
+// loadLists fills the channel's list cache from the database. It is called
+// with channelsMutex held as the channel goes live.
+func (channel *Channel) loadLists() error {
+	entries, err := getChannelLists(channel.ID)
+	if err != nil {
+		return err
+	}
+	channel.lists = make(map[rune][]listEntry)
+	for _, entry := range entries {
+		mode := []rune(entry.Mode)[0]
+		channel.lists[mode] = append(channel.lists[mode], entry)
+	}
+	return nil
+}
+
+// listEntries returns the unexpired entries on the channel's list for mode.
+func (channel *Channel) listEntries(mode rune) []listEntry {
+	channelsMutex.RLock()
+	defer channelsMutex.RUnlock()
+	now := time.Now().Unix()
+	var entries []listEntry
+	for _, entry := range channel.lists[mode] {
+		if !entry.ExpiresAt.Valid || entry.ExpiresAt.Int64 > now {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// addListEntry stores a mask on one of the channel's lists and reports
+// whether it was new. A zero expires means the entry never expires.
+func (channel *Channel) addListEntry(mode rune, mask, setBy string, expires time.Time) (bool, error) {
+	entry := listEntry{Mode: string(mode), Mask: mask, SetBy: setBy, SetAt: time.Now().Unix()}
+	if !expires.IsZero() {
+		entry.ExpiresAt = sql.NullInt64{Int64: expires.Unix(), Valid: true}
+	}
+	added, err := addChannelListEntry(channel.ID, entry)
+	if err != nil || !added {
+		return false, err
+	}
+	channelsMutex.Lock()
+	channel.lists[mode] = append(channel.lists[mode], entry)
+	channelsMutex.Unlock()
+	return true, nil
+}
+
+// removeListEntry removes a mask from one of the channel's lists and
+// reports whether it was there.
+func (channel *Channel) removeListEntry(mode rune, mask string) (bool, error) {
+	removed, err := removeChannelListEntry(channel.ID, mode, mask)
+	if err != nil || !removed {
+		return false, err
+	}
+	channel.forgetListEntry(mode, mask)
+	return true, nil
+}
+
+// forgetListEntry drops a mask from the list cache. Masks compare without
+// case, as in the database.
+func (channel *Channel) forgetListEntry(mode rune, mask string) {
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+	channel.lists[mode] = slices.DeleteFunc(channel.lists[mode], func(entry listEntry) bool {
+		return casefold(entry.Mask) == casefold(mask)
+	})
+}
+
+// matchesList reports whether any mask on the channel's list for mode
+// matches the client.
+func (channel *Channel) matchesList(client *Client, mode rune) bool {
+	for _, entry := range channel.listEntries(mode) {
+		if matchesBanMask(client, entry.Mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendChannelList shows one of the channel's lists to the client.
+func sendChannelList(client *Client, channel *Channel, mode *listMode) {
+	if mode.private && !channel.hasPrivilege(client, memberHalfop) {
+		client.sendNumeric(ERR_CHANOPRIVSNEEDED, channel.Name, "You're not channel operator")
+		return
+	}
+
+	entries := channel.listEntries(mode.letter)
+
+	// The quiet list replies name their mode, as on other servers
+	prefix := []string{channel.Name}
+	if mode.listNumeric == RPL_QUIETLIST {
+		prefix = append(prefix, string(mode.letter))
+	}
+	for _, entry := range entries {
+		client.sendNumeric(mode.listNumeric, append(prefix, entry.Mask, entry.SetBy, strconv.FormatInt(entry.SetAt, 10))...)
+	}
+	client.sendNumeric(mode.endNumeric, append(prefix, "End of channel "+mode.name+" list")...)
+}
+
+// setListEntry adds or removes a mask on one of the channel's lists for a
+// MODE command, and reports whether anything changed. New entries expire at
+// expires unless it is zero.
+func setListEntry(client *Client, channel *Channel, mode *listMode, adding bool, mask string, expires time.Time) bool {
+	if !adding {
+		removed, err := channel.removeListEntry(mode.letter, mask)
+		if err != nil {
+			log.Printf("Error removing +%c %s on %s: %v", mode.letter, mask, channel.Name, err)
+			client.sendNumeric(ERR_UNKNOWNERROR, "MODE", "Error removing mode '"+string(mode.letter)+"'")
+			return false
+		}
+		return removed
+	}
+
+	if isExtban(mask) {
+		if _, err := parseExtban(mask); err != nil {
+			client.sendNumeric(ERR_INVALIDMODEPARAM, channel.Name, string(mode.letter), mask, err.Error())
+			return false
+		}
+	}
+
+	if len(channel.listEntries(mode.letter)) >= maxListEntries {
+		client.sendNumeric(ERR_BANLISTFULL, channel.Name, mask, "Channel "+mode.name+" list is full")
+		return false
+	}
+
+	added, err := channel.addListEntry(mode.letter, mask, client.hostmask(), expires)
+	if err != nil {
+		log.Printf("Error adding +%c %s on %s: %v", mode.letter, mask, channel.Name, err)
+		client.sendNumeric(ERR_UNKNOWNERROR, "MODE", "Error setting mode '"+string(mode.letter)+"'")
+		return false
+	}
+	return added
+}
+
+// splitTimedMask splits a list mode argument of the form "duration:mask",
+// such as "1h:*!*@host", into the mask and when the entry should expire.
+// Arguments without a leading duration never expire. Hostmasks can't start
+// with a duration since nicknames don't start with digits.
+func splitTimedMask(arg string) (string, time.Time) {
+	prefix, mask, found := strings.Cut(arg, ":")
+	if !found || mask == "" {
+		return arg, time.Time{}
+	}
+	duration, err := parseListDuration(prefix)
+	if err != nil {
+		return arg, time.Time{}
+	}
+	return mask, time.Now().Add(duration)
+}
+
+// parseListDuration parses a duration such as "30m", "1h30m", "2d" or "1w".
+func parseListDuration(s string) (time.Duration, error) {
+	var duration time.Duration
+	var err error
+	switch {
+	case strings.HasSuffix(s, "d"), strings.HasSuffix(s, "w"):
+		var n int
+		n, err = strconv.Atoi(s[:len(s)-1])
+		duration = time.Duration(n) * 24 * time.Hour
+		if strings.HasSuffix(s, "w") {
+			duration *= 7
+		}
+	default:
+		duration, err = time.ParseDuration(s)
+	}
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return duration, nil
+}
+
+// expireListEntries removes list entries whose time is up and announces the
+// removals to their channels. It runs with the periodic maintenance.
+func expireListEntries() {
+	entries, err := removeExpiredListEntries(time.Now())
+	if err != nil {
+		log.Printf("Error expiring channel list entries: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		log.Printf("Expired +%s %s on %s (set by %s)", entry.Mode, entry.Mask, entry.ChannelName, entry.SetBy)
+		if channel := findChannel(entry.ChannelName); channel != nil {
+			channel.forgetListEntry([]rune(entry.Mode)[0], entry.Mask)
+			broadcastToChannel(channel, newRelayMessage(ServerNameString, "MODE", channel.Name, "-"+entry.Mode, entry.Mask))
+		}
+	}
+}
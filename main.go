@@ -1,13 +1,19 @@
 package main
 
 import (
+	"crypto/tls"
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
@@ -15,7 +21,9 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-const ServerNameString = "SquishIRC"
+// ServerNameString is set from the configuration at startup.
+var ServerNameString = "SquishIRC"
+
 const ServerVersionString = "v0.1.2"
 
 const (
@@ -29,7 +37,11 @@ const (
 	RPL_CREATED          = "003"
 	RPL_MYINFO           = "004"
 	RPL_ISUPPORT         = "005"
+	RPL_SNOMASK          = "008"
+	RPL_STATSKLINE       = "216"
+	RPL_ENDOFSTATS       = "219"
 	RPL_UMODEIS          = "221"
+	RPL_STATSDLINE       = "225"
 	RPL_LUSERCLIENT      = "251"
 	RPL_LUSEROP          = "252"
 	RPL_LUSERUNKNOWN     = "253"
@@ -45,9 +57,18 @@ const (
 	RPL_ENDOFWHOIS       = "318"
 	RPL_WHOISCHANNELS    = "319"
 	RPL_CHANNELMODEIS    = "324"
+	RPL_LIST             = "322"
+	RPL_LISTEND          = "323"
 	RPL_NOTOPIC          = "331"
 	RPL_TOPIC            = "332"
+	RPL_TOPICWHOTIME     = "333"
+	RPL_INVITELIST       = "336"
+	RPL_ENDOFINVITELIST  = "337"
 	RPL_INVITING         = "341"
+	RPL_INVEXLIST        = "346"
+	RPL_ENDOFINVEXLIST   = "347"
+	RPL_EXCEPTLIST       = "348"
+	RPL_ENDOFEXCEPTLIST  = "349"
 	RPL_NAMREPLY         = "353"
 	RPL_ENDOFNAMES       = "366"
 	RPL_MOTD             = "372"
@@ -56,6 +77,8 @@ const (
 	RPL_WHOREPLY         = "352"
 	RPL_ENDOFWHO         = "315"
 	RPL_YOUREOPER        = "381"
+	RPL_REHASHING        = "382"
+	RPL_WHOISSECURE      = "671"
 	ERR_UNKNOWNERROR     = "400"
 	ERR_NOSUCHNICK       = "401"
 	ERR_NOSUCHSERVER     = "402"
@@ -64,8 +87,10 @@ const (
 	ERR_TOOMANYCHANNELS  = "405"
 	ERR_WASNOSUCHNICK    = "406"
 	ERR_NOORIGIN         = "409"
+	ERR_INVALIDCAPCMD    = "410"
 	ERR_NORECIPIENT      = "411"
 	ERR_NOTEXTTOSEND     = "412"
+	ERR_INPUTTOOLONG     = "417"
 	ERR_UNKNOWNCOMMAND   = "421"
 	ERR_NOMOTD           = "422"
 	ERR_NONICKNAMEGIVEN  = "431"
@@ -78,11 +103,13 @@ const (
 	ERR_NEEDMOREPARAMS   = "461"
 	ERR_ALREADYREGISTRED = "462"
 	ERR_PASSWDMISMATCH   = "464"
+	ERR_YOUREBANNEDCREEP = "465"
 	ERR_CHANNELISFULL    = "471"
 	ERR_UNKNOWNMODE      = "472"
 	ERR_INVITEONLYCHAN   = "473"
 	ERR_BANNEDFROMCHAN   = "474"
 	ERR_BADCHANNELKEY    = "475"
+	ERR_BANLISTFULL      = "478"
 	ERR_NOPRIVILEGES     = "481"
 	ERR_CHANOPRIVSNEEDED = "482"
 	ERR_CANTKILLSERVER   = "483"
@@ -91,6 +118,16 @@ const (
 	ERR_USERSDONTMATCH   = "502"
 	RPL_BANLIST          = "367"
 	RPL_ENDOFBANLIST     = "368"
+	ERR_INVALIDMODEPARAM = "696"
+	RPL_QUIETLIST        = "728"
+	RPL_ENDOFQUIETLIST   = "729"
+	RPL_LOGGEDIN         = "900"
+	RPL_SASLSUCCESS      = "903"
+	ERR_SASLFAIL         = "904"
+	ERR_SASLTOOLONG      = "905"
+	ERR_SASLABORTED      = "906"
+	ERR_SASLALREADY      = "907"
+	RPL_SASLMECHS        = "908"
 )
 
 var startTime = time.Now()
@@ -106,18 +143,55 @@ type Client struct {
 	Email        string     `db:"email" json:"email"`
 	Channels     []*Channel `db:"-" json:"channels,omitempty"`
 	Invisible    bool       `db:"invisible" json:"invisible"`
-	IsOperator   bool       `db:"is_operator" json:"is_operator"`
+	IsOperator   bool       `db:"-" json:"is_operator"`
 	HasVoice     bool       `db:"has_voice" json:"has_voice"`
 	CreatedAt    time.Time  `db:"created_at" json:"created_at"`
 	IsIdentified bool       `db:"is_identified" json:"is_identified"`
 	LastSeen     time.Time  `db:"last_seen" json:"last_seen"`
+	IsSecure     bool       `db:"-" json:"is_secure"`
+	CertFP       string     `db:"-" json:"-"`
+	// Account is the name the client logged in as with SASL or NickServ
+	// IDENTIFY. It stays the same if the client changes nick.
+	Account string `db:"-" json:"account,omitempty"`
+	// AccountID is the user ID of Account.
+	AccountID int64 `db:"-" json:"-"`
+	// OperName is the operator block the client used with OPER.
+	OperName  string `db:"-" json:"oper_name,omitempty"`
+	operClass string
+	// Wallops is user mode +w, receiving WALLOPS.
+	Wallops bool `db:"-" json:"-"`
+	// snomask is the server notices an operator gets with +s, e.g. "ckx".
+	snomask string
+
+	// Enabled capabilities and the CAP version, readable from any goroutine.
+	caps       atomic.Uint32
+	capVersion atomic.Int32
+	// Negotiation and SASL state, touched only by the client's own goroutine.
+	capNegotiating bool
+	sasl           *saslSession
+	saslFailures   int
+
+	// Outbound queue, drained by the writer goroutine. sendMu guards
+	// everything below it.
+	sendReady  chan struct{}
+	writerDone chan struct{}
+	sendMu     sync.Mutex
+	sendQueue  [][]byte
+	sendQBytes int
+	sendClosed bool
+	quitReason string
+
+	// Flood control. recvQBytes is what the reader has queued but the
+	// command loop hasn't handled yet; readErr is why the reader stopped.
+	recvQBytes atomic.Int64
+	readErr    error
+	floodClock time.Time
 }
 
 type Channel struct {
 	ID                 int64          `db:"id" json:"id"`
 	Name               string         `db:"name" json:"name"`
 	Topic              string         `db:"topic" json:"topic"`
-	Clients            []*Client      `db:"-" json:"clients,omitempty"`
 	NoExternalMessages bool           `db:"no_external_messages" json:"no_external_messages"`
 	TopicProtection    bool           `db:"topic_protection" json:"topic_protection"`
 	Moderated          bool           `db:"moderated" json:"moderated"`
@@ -127,15 +201,17 @@ type Channel struct {
 	CreatedAt          time.Time      `db:"created_at" json:"created_at"`
 	IsRegistered       bool           `db:"is_registered" json:"is_registered"`
 	FounderID          sql.NullInt64  `db:"founder_id" json:"founder_id"`
-}
-
-// Add a new struct to represent the user_channels relationship
-type UserChannel struct {
-	UserID     int64     `db:"user_id"`
-	ChannelID  int64     `db:"channel_id"`
-	IsOperator bool      `db:"is_operator"`
-	HasVoice   bool      `db:"has_voice"`
-	JoinedAt   time.Time `db:"joined_at"`
+	Secret             bool           `db:"secret" json:"secret"`
+	Private            bool           `db:"private" json:"private"`
+	// Flood is the +f setting, "lines:seconds[:action]", or "" if unset.
+	Flood string `db:"flood" json:"flood,omitempty"`
+
+	members map[*Client]*Membership `db:"-"`
+	// invites maps invited clients to when their invite expires.
+	invites map[*Client]time.Time `db:"-"`
+	// lists caches the channel's mask lists by mode letter, so messages can
+	// be checked against them without a query.
+	lists map[rune][]listEntry `db:"-"`
 }
 
 type ChanServType struct {
@@ -143,10 +219,16 @@ type ChanServType struct {
 }
 
 var (
+	// configPath is the -config file, reread by REHASH.
+	configPath string
+	// listeners are closed by DIE and RESTART.
+	listeners []net.Listener
+
 	DB               *sqlx.DB
 	ChanServ         *ChanServType
-	connectedClients map[string]*Client
+	connectedClients map[string]*Client // keyed by casefolded nickname
 	clientsMutex     sync.RWMutex
+	channelsMutex    sync.RWMutex
 )
 
 func main() {
@@ -158,14 +240,29 @@ func main() {
 		}
 	}()
 
-	log.Println("Starting Squish on 6667")
-	ln, err := net.Listen("tcp", ":6667")
+	flag.StringVar(&configPath, "config", "", "path to the JSON configuration file")
+	mkpasswd := flag.Bool("mkpasswd", false, "read a password from stdin, print its bcrypt hash for an operator block and exit")
+	flag.Parse()
+
+	if *mkpasswd {
+		if err := printPasswordHash(); err != nil {
+			log.Fatalf("Failed to hash password: %v", err)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(configPath)
 	if err != nil {
-		log.Fatalln(err)
+		log.Fatalf("Failed to load configuration: %v", err)
 	}
-	defer ln.Close()
+	currentConfig.Store(cfg)
+	ServerNameString = config().ServerName
 
-	DB, err = startDB()
+	if err := loadMotd(); err != nil {
+		log.Printf("Failed to read MOTD file: %v", err)
+	}
+
+	DB, err = startDB(config().DatabasePath)
 	if err != nil {
 		log.Fatalf("Failed to start database: %v", err)
 	}
@@ -174,81 +271,180 @@ func main() {
 	// Initialize the ChanServ object
 	ChanServ = NewChanServ()
 
-	// Initialize default channels
+	// Make registered channels live, then make sure the defaults exist
+	if err := loadRegisteredChannels(); err != nil {
+		log.Fatalf("Failed to load registered channels: %v", err)
+	}
 	initializeDefaultChannels()
 
+	if err := loadServerBans(); err != nil {
+		log.Fatalf("Failed to load server bans: %v", err)
+	}
+
 	connectedClients = make(map[string]*Client)
 
+	for _, listener := range config().Listeners {
+		log.Printf("Starting Squish on %s", listener.Address)
+		ln, err := net.Listen("tcp", listener.Address)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer ln.Close()
+		listeners = append(listeners, ln)
+
+		if listener.TLS {
+			reloader, err := newCertReloader(listener.CertFile, listener.KeyFile)
+			if err != nil {
+				log.Fatalf("Failed to load TLS certificate for %s: %v", listener.Address, err)
+			}
+			ln = tls.NewListener(ln, newTLSConfig(reloader))
+			log.Printf("TLS enabled on %s", listener.Address)
+		}
+
+		go acceptConnections(ln)
+	}
+
+	go watchCertificates()
+
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
+	// Periodic maintenance
+	for range ticker.C {
+		pruneHistory()
+		expireListEntries()
+		expireServerBans()
+		connections.pruneThrottles()
+	}
+}
+
+func acceptConnections(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 		log.Println("conn: client connected:", conn.RemoteAddr())
 
-		go handleConnection(conn)
+		if ban := dLineFor(remoteIP(conn)); ban != nil {
+			go rejectConnection(conn, ban.quitMessage())
+			continue
+		}
+		release, reason := connections.admit(remoteIP(conn))
+		if reason != "" {
+			go rejectConnection(conn, reason)
+			continue
+		}
+		go func() {
+			defer release()
+			handleConnection(conn)
+		}()
 	}
 }
 
-func broadcastMessage(channel *Channel, sender *Client, message string) {
-	for _, client := range channel.Clients {
+// broadcastMessage sends msg to everyone in the channel except the sender.
+func broadcastMessage(channel *Channel, sender *Client, msg *Message) {
+	for _, client := range channel.clients() {
 		if client != sender {
-			client.conn.Write([]byte(fmt.Sprintf(":%s PRIVMSG %s %s\r\n", sender.Nickname, channel.Name, message)))
+			client.send(msg)
 		}
 	}
 }
 
-func sendMotd(client *Client) {
-	motdPath := "server.motd.txt"
-	motdBytes, err := os.ReadFile(motdPath)
+// motd holds the MOTD file's lines, read at startup and on REHASH. lines is
+// nil if the file couldn't be read.
+var motd struct {
+	sync.RWMutex
+	lines []string
+}
+
+func loadMotd() error {
+	motdBytes, err := os.ReadFile(config().MotdPath)
 	if err != nil {
-		log.Printf("Failed to read MOTD file: %v", err)
-		return
+		motd.Lock()
+		motd.lines = nil
+		motd.Unlock()
+		return err
 	}
-	motdContent := string(motdBytes)
 
-	lines := strings.Split(motdContent, "\n")
-	for _, line := range lines {
-		if line != "" {
-			client.conn.Write([]byte(fmt.Sprintf(":%s 372 %s :- %s\r\n", ServerNameString, client.Nickname, line)))
+	lines := []string{}
+	for _, line := range strings.Split(string(motdBytes), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
 		}
 	}
+	motd.Lock()
+	motd.lines = lines
+	motd.Unlock()
+	return nil
+}
+
+func sendMotd(client *Client) {
+	motd.RLock()
+	lines := motd.lines
+	motd.RUnlock()
 
-	client.conn.Write([]byte(fmt.Sprintf(":%s 376 %s :End of /MOTD command.\r\n", ServerNameString, client.Nickname)))
+	if lines == nil {
+		client.sendNumeric(ERR_NOMOTD, "MOTD File is missing")
+		return
+	}
+	for _, line := range lines {
+		client.sendNumeric(RPL_MOTD, "- "+line)
+	}
+
+	client.sendNumeric(RPL_ENDOFMOTD, "End of /MOTD command.")
 }
 
 func sendWelcomeMessages(client *Client) {
 	log.Printf("Sending welcome messages to %s", client.Nickname)
 	startTimeStr := startTime.Format(time.RFC3339)
-	messages := []string{
-		fmt.Sprintf(":%s 001 %s :Welcome to SquishIRC\r\n", ServerNameString, client.Nickname),
-		fmt.Sprintf(":%s 002 %s :Your host is %s, running version "+ServerVersionString+"\r\n", ServerNameString, client.Nickname, ServerNameString),
-		fmt.Sprintf(":%s 003 %s :This server achieved liftoff on %s\r\n", ServerNameString, client.Nickname, startTimeStr),
-		fmt.Sprintf(":%s 004 %s %s "+ServerVersionString+" o o\r\n", ServerNameString, client.Nickname, ServerNameString),
-	}
+	client.sendNumeric(RPL_WELCOME, "Welcome to "+ServerNameString)
+	client.sendNumeric(RPL_YOURHOST, fmt.Sprintf("Your host is %s, running version %s", ServerNameString, ServerVersionString))
+	client.sendNumeric(RPL_CREATED, "This server achieved liftoff on "+startTimeStr)
+	client.sendNumeric(RPL_MYINFO, ServerNameString, ServerVersionString, "iosw", "o")
+	sendISupport(client)
 
-	for _, msg := range messages {
-		_, err := client.conn.Write([]byte(msg))
-		if err != nil {
-			log.Printf("Error sending welcome message to %s: %v", client.conn.RemoteAddr().String(), err)
-			return
-		}
-		log.Printf("Sent welcome message to %s: %s", client.Nickname, strings.TrimSpace(msg))
+	sendMotd(client)
+}
+
+// isupportTokens lists the features advertised in RPL_ISUPPORT.
+func isupportTokens() []string {
+	tokens := []string{
+		"CASEMAPPING=ascii",
+		"CHANTYPES=#",
+		"NETWORK=" + ServerNameString,
+		"NICKLEN=" + strconv.Itoa(config().Limits.NickLength),
+		"PREFIX=" + prefixISupport(),
+		"CHANMODES=" + listModeLetters() + ",k,fl,imnpst",
+		"EXCEPTS=e",
+		"EXTBAN=" + extbanISupport(),
+		"INVEX=I",
+		"MAXLIST=" + listModeLetters() + ":" + strconv.Itoa(maxListEntries),
 	}
+	if historyEnabled() {
+		tokens = append(tokens, "CHATHISTORY="+strconv.Itoa(config().History.QueryLimit), "MSGREFTYPES=msgid,timestamp")
+	}
+	return tokens
+}
 
-	sendMotd(client)
+// sendISupport sends the ISUPPORT tokens, at most 13 per line.
+func sendISupport(client *Client) {
+	tokens := isupportTokens()
+	for len(tokens) > 0 {
+		n := min(len(tokens), 13)
+		params := append(tokens[:n:n], "are supported by this server")
+		client.sendNumeric(RPL_ISUPPORT, params...)
+		tokens = tokens[n:]
+	}
 }
 
 func removeClient(client *Client) {
-	for _, channel := range client.Channels {
-		err := removeClientFromChannel(client, channel)
-		if err != nil {
-			log.Printf("Error removing client from channel: %v", err)
-		}
+	for _, channel := range client.channelList() {
+		removeClientFromChannel(client, channel)
 	}
 }
 
@@ -265,23 +461,19 @@ func sanitizeString(input string) string {
 func findClientByNickname(nickname string) *Client {
 	clientsMutex.RLock()
 	defer clientsMutex.RUnlock()
-	return connectedClients[nickname]
+	return connectedClients[casefold(nickname)]
 }
 
 func notifyNicknameChange(client *Client, oldNickname, newNickname string) {
-	for _, channel := range client.Channels {
-		for _, c := range channel.Clients {
-			if c != client {
-				c.conn.Write([]byte(fmt.Sprintf(":%s NICK %s\r\n", oldNickname, newNickname)))
-			}
-		}
+	nickMessage := newMessage(oldNickname, "NICK", newNickname)
+	for _, c := range channelPeers(client) {
+		c.send(nickMessage)
 	}
 }
 
 // Add this new function
 func initializeDefaultChannels() {
-	defaultChannels := []string{"#general", "#help", "#random"}
-	for _, channelName := range defaultChannels {
+	for _, channelName := range config().DefaultChannels {
 		log.Printf("Initializing default channel: %s", channelName)
 		channel, err := getOrCreateChannel(channelName)
 		if err != nil {
@@ -289,7 +481,7 @@ func initializeDefaultChannels() {
 			continue
 		}
 		if !channel.IsRegistered {
-			err = setChannelRegistered(channel.ID, 0) // Use 0 as the founder ID for server-created channels
+			err = setChannelRegistered(channel, 0) // Use 0 as the founder ID for server-created channels
 			if err != nil {
 				log.Printf("Error registering default channel %s: %v", channelName, err)
 			} else {
@@ -305,20 +497,34 @@ func initializeDefaultChannels() {
 func addConnectedClient(client *Client) {
 	clientsMutex.Lock()
 	defer clientsMutex.Unlock()
-	connectedClients[client.Nickname] = client
+	connectedClients[casefold(client.Nickname)] = client
+}
+
+func connectedClientList() []*Client {
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
+
+	clients := make([]*Client, 0, len(connectedClients))
+	for _, client := range connectedClients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Nickname < clients[j].Nickname
+	})
+	return clients
 }
 
 func removeConnectedClient(nickname string) {
 	clientsMutex.Lock()
 	defer clientsMutex.Unlock()
-	delete(connectedClients, nickname)
+	delete(connectedClients, casefold(nickname))
 }
 
 func updateConnectedClientNickname(oldNickname, newNickname string) {
 	clientsMutex.Lock()
 	defer clientsMutex.Unlock()
-	if client, ok := connectedClients[oldNickname]; ok {
-		delete(connectedClients, oldNickname)
-		connectedClients[newNickname] = client
+	if client, ok := connectedClients[casefold(oldNickname)]; ok {
+		delete(connectedClients, casefold(oldNickname))
+		connectedClients[casefold(newNickname)] = client
 	}
 }
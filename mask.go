@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// casefold lowercases ASCII letters only, matching CASEMAPPING=ascii.
+func casefold(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, s)
+}
+
+// globMatch reports whether s matches pattern, where * matches any run of
+// characters and ? matches exactly one. Comparison uses the server's
+// casemapping.
+func globMatch(pattern, s string) bool {
+	pat, str := []rune(casefold(pattern)), []rune(casefold(s))
+
+	p, i := 0, 0
+	// Where to resume after the last *, if the match so far fails
+	star, resume := -1, 0
+	for i < len(str) {
+		switch {
+		case p < len(pat) && pat[p] == '*':
+			star, resume = p, i
+			p++
+		case p < len(pat) && (pat[p] == '?' || pat[p] == str[i]):
+			p++
+			i++
+		case star >= 0:
+			resume++
+			p, i = star+1, resume
+		default:
+			return false
+		}
+	}
+	for p < len(pat) && pat[p] == '*' {
+		p++
+	}
+	return p == len(pat)
+}
+
+// normalizeMask expands a partial mask to the full nick!user@host form:
+// "nick" becomes "nick!*@*", "user@host" becomes "*!user@host" and
+// "nick!user" becomes "nick!user@*". Empty parts become *. Extended bans
+// are left as they are.
+func normalizeMask(mask string) string {
+	if isExtban(mask) {
+		return mask
+	}
+	nick, user, host := mask, "*", "*"
+	if before, after, found := strings.Cut(mask, "!"); found {
+		nick, user = before, after
+		if at := strings.LastIndex(after, "@"); at >= 0 {
+			user, host = after[:at], after[at+1:]
+		}
+	} else if at := strings.LastIndex(mask, "@"); at >= 0 {
+		nick, user, host = "*", mask[:at], mask[at+1:]
+	}
+
+	for _, part := range []*string{&nick, &user, &host} {
+		if *part == "" {
+			*part = "*"
+		}
+	}
+	return nick + "!" + user + "@" + host
+}
+
+// splitMask splits a normalized mask into its nick, user and host parts.
+func splitMask(mask string) (nick, user, host string) {
+	nick, rest, _ := strings.Cut(mask, "!")
+	at := strings.LastIndex(rest, "@")
+	return nick, rest[:at], rest[at+1:]
+}
+
+// matchesMask reports whether the client matches a nick!user@host mask. The
+// host part is matched against both the client's hostname and its IP
+// address, and may also be a CIDR range such as 192.0.2.0/24.
+func (client *Client) matchesMask(mask string) bool {
+	nickPart, userPart, hostPart := splitMask(normalizeMask(mask))
+
+	if !globMatch(nickPart, client.Nickname) || !globMatch(userPart, client.Username) {
+		return false
+	}
+	if globMatch(hostPart, client.Hostname) {
+		return true
+	}
+
+	ip := client.ip()
+	if ip == nil {
+		return false
+	}
+	if _, network, err := net.ParseCIDR(hostPart); err == nil {
+		return network.Contains(ip)
+	}
+	return globMatch(hostPart, ip.String())
+}
+
+// ip returns the address the client connected from, or nil if it has no
+// network connection.
+func (client *Client) ip() net.IP {
+	if client.conn == nil {
+		return nil
+	}
+	return remoteIP(client.conn)
+}
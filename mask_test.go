@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "abc", true},
+		{"*", "*abc", true},
+		{"a*", "a*b", true},
+		{"*!*@*", "*nick!user@host", true},
+		{"*!*evil@*", "mallory!*evil@host", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"abc", "ABC", true},
+		{"*.example.com", "irc.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"*a", "ba*", false},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// serverTimeFormat is the IRCv3 server-time format, always in UTC.
+const serverTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// maxClientTagData is the most tag data a client may attach to a message.
+const maxClientTagData = 4094
+
+// Message is a single parsed IRC line as described by RFC 1459 and the
+// IRCv3 message-tags specification:
+//
+//	[@tags] [:source] <command> [params...] [:trailing]
+type Message struct {
+	Tags    map[string]string
+	Source  string
+	Command string
+	Params  []string
+}
+
+func newMessage(source, command string, params ...string) *Message {
+	return &Message{Source: source, Command: command, Params: params}
+}
+
+// newRelayMessage builds a message relayed on behalf of a user. It carries
+// server-time and a msgid; send drops them for clients that didn't
+// negotiate the matching capability.
+func newRelayMessage(source, command string, params ...string) *Message {
+	msg := newMessage(source, command, params...)
+	msg.Tags = map[string]string{
+		"time":  time.Now().UTC().Format(serverTimeFormat),
+		"msgid": newMsgID(),
+	}
+	return msg
+}
+
+var msgIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newMsgID returns a random, unique message ID.
+func newMsgID() string {
+	id := make([]byte, 15)
+	rand.Read(id)
+	return strings.ToLower(msgIDEncoding.EncodeToString(id))
+}
+
+// withTags adds tags to the message and returns it.
+func (msg *Message) withTags(tags map[string]string) *Message {
+	if msg.Tags == nil && len(tags) > 0 {
+		msg.Tags = make(map[string]string, len(tags))
+	}
+	for key, value := range tags {
+		msg.Tags[key] = value
+	}
+	return msg
+}
+
+// clientTags returns the client-only (+) tags of a message the client sent.
+// Tags from clients that didn't negotiate message-tags are ignored. ok is
+// false if the tags were too long and the client was told so.
+func (client *Client) clientTags(msg *Message) (tags map[string]string, ok bool) {
+	if !client.hasCap(capMessageTags) {
+		return nil, true
+	}
+
+	for key, value := range msg.Tags {
+		if !strings.HasPrefix(key, "+") {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[key] = value
+	}
+	if len(formatTags(tags)) > maxClientTagData {
+		client.sendNumeric(ERR_INPUTTOOLONG, "Input line was too long")
+		return nil, false
+	}
+	return tags, true
+}
+
+// forClient returns the message with any tags the client can't receive
+// removed: time needs server-time, batch needs batch and everything else
+// needs message-tags.
+func (msg *Message) forClient(client *Client) *Message {
+	if len(msg.Tags) == 0 {
+		return msg
+	}
+	allowed := func(key string) bool {
+		switch key {
+		case "time":
+			return client.hasCap(capServerTime)
+		case "batch":
+			return client.hasCap(capBatch)
+		}
+		return client.hasCap(capMessageTags)
+	}
+
+	filtered := *msg
+	filtered.Tags = make(map[string]string, len(msg.Tags))
+	for key, value := range msg.Tags {
+		if allowed(key) {
+			filtered.Tags[key] = value
+		}
+	}
+	if len(filtered.Tags) == len(msg.Tags) {
+		return msg
+	}
+	return &filtered
+}
+
+// parseMessage parses a raw line (without the trailing CRLF) into a Message.
+// The command is upper-cased and the trailing parameter, if any, is appended
+// to Params with its leading colon removed.
+func parseMessage(line string) (*Message, error) {
+	line = strings.TrimRight(line, "\r\n")
+	msg := &Message{}
+
+	if strings.HasPrefix(line, "@") {
+		end := strings.IndexByte(line, ' ')
+		if end == -1 {
+			return nil, fmt.Errorf("message has tags but no command")
+		}
+		msg.Tags = parseTags(line[1:end])
+		line = strings.TrimLeft(line[end:], " ")
+	}
+
+	if strings.HasPrefix(line, ":") {
+		end := strings.IndexByte(line, ' ')
+		if end == -1 {
+			return nil, fmt.Errorf("message has a source but no command")
+		}
+		msg.Source = line[1:end]
+		line = strings.TrimLeft(line[end:], " ")
+	}
+
+	for line != "" {
+		if strings.HasPrefix(line, ":") && msg.Command != "" {
+			msg.Params = append(msg.Params, line[1:])
+			break
+		}
+		var field string
+		if end := strings.IndexByte(line, ' '); end == -1 {
+			field, line = line, ""
+		} else {
+			field, line = line[:end], strings.TrimLeft(line[end:], " ")
+		}
+		if msg.Command == "" {
+			msg.Command = strings.ToUpper(field)
+		} else {
+			msg.Params = append(msg.Params, field)
+		}
+	}
+
+	if msg.Command == "" {
+		return nil, fmt.Errorf("message has no command")
+	}
+	return msg, nil
+}
+
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(tag, "=")
+		tags[key] = unescapeTagValue(value)
+	}
+	return tags
+}
+
+var tagValueEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+func unescapeTagValue(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			sb.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i == len(value) {
+			break
+		}
+		switch value[i] {
+		case ':':
+			sb.WriteByte(';')
+		case 's':
+			sb.WriteByte(' ')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'n':
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(value[i])
+		}
+	}
+	return sb.String()
+}
+
+// Param returns the i-th parameter or an empty string if it is missing.
+func (msg *Message) Param(i int) string {
+	if i < 0 || i >= len(msg.Params) {
+		return ""
+	}
+	return msg.Params[i]
+}
+
+// String serializes the message without the trailing CRLF. The last
+// parameter is sent as a trailing parameter when it needs to be.
+func (msg *Message) String() string {
+	var sb strings.Builder
+
+	if len(msg.Tags) > 0 {
+		sb.WriteByte('@')
+		sb.WriteString(formatTags(msg.Tags))
+		sb.WriteByte(' ')
+	}
+
+	if msg.Source != "" {
+		sb.WriteByte(':')
+		sb.WriteString(msg.Source)
+		sb.WriteByte(' ')
+	}
+
+	sb.WriteString(msg.Command)
+
+	for i, param := range msg.Params {
+		sb.WriteByte(' ')
+		if i == len(msg.Params)-1 && (param == "" || strings.HasPrefix(param, ":") || strings.ContainsRune(param, ' ')) {
+			sb.WriteByte(':')
+		}
+		sb.WriteString(param)
+	}
+
+	return sb.String()
+}
+
+// formatTags serializes tags in wire format, without the leading '@'.
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for i, key := range keys {
+		if i > 0 {
+			sb.WriteByte(';')
+		}
+		sb.WriteString(key)
+		if value := tags[key]; value != "" {
+			sb.WriteByte('=')
+			sb.WriteString(tagValueEscaper.Replace(value))
+		}
+	}
+	return sb.String()
+}
+
+// hostmask returns the client's nick!user@host source.
+func (client *Client) hostmask() string {
+	return fmt.Sprintf("%s!%s@%s", client.Nickname, client.Username, client.Hostname)
+}
+
+// nickOrStar returns the client's nickname, or "*" before one has been set.
+func (client *Client) nickOrStar() string {
+	if client.Nickname == "" {
+		return "*"
+	}
+	return client.Nickname
+}
+
+func (client *Client) sendNumeric(numeric string, params ...string) {
+	client.send(newMessage(ServerNameString, numeric, append([]string{client.nickOrStar()}, params...)...))
+}
+
+func (client *Client) sendNotice(source, text string) {
+	client.send(newMessage(source, "NOTICE", client.nickOrStar(), text))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		line string
+		want Message
+	}{
+		{"PING", Message{Command: "PING"}},
+		{"privmsg #chan :hi", Message{Command: "PRIVMSG", Params: []string{"#chan", "hi"}}},
+		{":nick!user@host PRIVMSG #chan :hello", Message{Source: "nick!user@host", Command: "PRIVMSG", Params: []string{"#chan", "hello"}}},
+		{"USER guest 0 * :Real Name", Message{Command: "USER", Params: []string{"guest", "0", "*", "Real Name"}}},
+		{"PRIVMSG   #chan    :a  b  ", Message{Command: "PRIVMSG", Params: []string{"#chan", "a  b  "}}},
+		{"MODE  #chan  +o   nick", Message{Command: "MODE", Params: []string{"#chan", "+o", "nick"}}},
+		{"TOPIC #chan :", Message{Command: "TOPIC", Params: []string{"#chan", ""}}},
+		{"PRIVMSG #chan ::)", Message{Command: "PRIVMSG", Params: []string{"#chan", ":)"}}},
+		{"PRIVMSG #chan :a :b", Message{Command: "PRIVMSG", Params: []string{"#chan", "a :b"}}},
+		{"PING :irc.example.com\r\n", Message{Command: "PING", Params: []string{"irc.example.com"}}},
+		{
+			"@time=2024-01-01T00:00:00.000Z;+draft/reply=abc :nick PRIVMSG #chan :hi",
+			Message{
+				Tags:    map[string]string{"time": "2024-01-01T00:00:00.000Z", "+draft/reply": "abc"},
+				Source:  "nick",
+				Command: "PRIVMSG",
+				Params:  []string{"#chan", "hi"},
+			},
+		},
+		{"@a;b=;c=1   TAGMSG #chan", Message{Tags: map[string]string{"a": "", "b": "", "c": "1"}, Command: "TAGMSG", Params: []string{"#chan"}}},
+		{`@k=a\sb\:c\\d\r\n TAGMSG #chan`, Message{Tags: map[string]string{"k": "a b;c\\d\r\n"}, Command: "TAGMSG", Params: []string{"#chan"}}},
+	}
+	for _, tt := range tests {
+		got, err := parseMessage(tt.line)
+		if err != nil {
+			t.Errorf("parseMessage(%q) returned error: %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("parseMessage(%q) = %#v, want %#v", tt.line, *got, tt.want)
+		}
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	for _, line := range []string{"", "   ", ":source", "@tag=1", "@tag=1 :source"} {
+		if msg, err := parseMessage(line); err == nil {
+			t.Errorf("parseMessage(%q) = %#v, want an error", line, *msg)
+		}
+	}
+}
+
+func TestUnescapeTagValue(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"plain", "plain"},
+		{`a\sb`, "a b"},
+		{`a\:b`, "a;b"},
+		{`a\\b`, `a\b`},
+		{`\r\n`, "\r\n"},
+		{`a\b`, "ab"},
+		{`trailing\`, "trailing"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := unescapeTagValue(tt.raw); got != tt.want {
+			t.Errorf("unescapeTagValue(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestMessageString(t *testing.T) {
+	tests := []struct {
+		msg  *Message
+		want string
+	}{
+		{newMessage("", "PING", "irc.example.com"), "PING irc.example.com"},
+		{newMessage("server", "001", "nick", "Welcome"), ":server 001 nick Welcome"},
+		{newMessage("nick!user@host", "PRIVMSG", "#chan", "hello there"), ":nick!user@host PRIVMSG #chan :hello there"},
+		{newMessage("nick", "TOPIC", "#chan", ""), ":nick TOPIC #chan :"},
+		{newMessage("nick", "PRIVMSG", "#chan", ":)"), ":nick PRIVMSG #chan ::)"},
+		{newMessage("", "QUIT"), "QUIT"},
+		{
+			newMessage("nick", "TAGMSG", "#chan").withTags(map[string]string{"+typing": "active", "msgid": "abc"}),
+			"@+typing=active;msgid=abc :nick TAGMSG #chan",
+		},
+		{
+			newMessage("", "TAGMSG", "#chan").withTags(map[string]string{"k": "a b;c\\d\r\n", "flag": ""}),
+			`@flag;k=a\sb\:c\\d\r\n TAGMSG #chan`,
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.msg.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+// TestMessageRoundTrip checks that serializing a parsed line and parsing it
+// again gives the same message. The line itself may change, since String
+// only uses a trailing parameter when it has to.
+func TestMessageRoundTrip(t *testing.T) {
+	lines := []string{
+		"PING irc.example.com",
+		":nick!user@host PRIVMSG #chan :hello there",
+		":nick PRIVMSG #chan ::)",
+		":nick TOPIC #chan :",
+		"MODE  #chan +ov nick1   nick2",
+		"USER guest 0 * :Real Name",
+		"@+draft/reply=abc;time=2024-01-01T00:00:00.000Z :nick PRIVMSG #chan :hi",
+		`@flag;k=a\sb\:c\\d\r\n :nick TAGMSG #chan`,
+	}
+	for _, line := range lines {
+		msg, err := parseMessage(line)
+		if err != nil {
+			t.Errorf("parseMessage(%q) returned error: %v", line, err)
+			continue
+		}
+		serialized := msg.String()
+		again, err := parseMessage(serialized)
+		if err != nil {
+			t.Errorf("parseMessage(%q) returned error: %v", serialized, err)
+			continue
+		}
+		if !reflect.DeepEqual(again, msg) {
+			t.Errorf("%q became %q, which parses as %#v, want %#v", line, serialized, *again, *msg)
+		}
+	}
+}
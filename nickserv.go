@@ -10,15 +10,9 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-// IRC numeric replies
-const (
-	RPL_NOTICE = "NOTICE"
-)
-
 const NickServNick = "NickServ"
 
 func handleNickServMessage(client *Client, message string) {
-	log.Printf("NickServ received message from %s: %s", client.Nickname, message)
 	parts := strings.Fields(message)
 	if len(parts) < 1 {
 		sendNickServHelp(client)
@@ -89,7 +83,11 @@ func handleNickServRegister(client *Client, args []string) {
 		return
 	}
 
-	log.Printf("Nickname %s registered successfully with password hash: %s", client.Nickname, client.Password)
+	if err := setScramPassword(client.ID, password); err != nil {
+		log.Printf("Error saving SCRAM credentials for %s: %v", client.Nickname, err)
+	}
+
+	log.Printf("Nickname %s registered successfully", client.Nickname)
 	sendNickServMessage(client, fmt.Sprintf("Nickname %s registered successfully", client.Nickname))
 	sendNickServMessage(client, "You can now identify using /msg NickServ IDENTIFY <nickname> <password>")
 }
@@ -114,28 +112,30 @@ func handleNickServIdentify(client *Client, args []string) {
 		return
 	}
 
+	// Nicknames match without case; use the registered spelling
+	targetNick = existingClient.Nickname
 	log.Printf("Attempting to verify password for %s", targetNick)
-	log.Printf("Stored password hash: '%s'", existingClient.Password)
-	log.Printf("Supplied password: '%s'", password)
 
 	if verifyPassword(existingClient.Password, password) {
-		// If the client is using a different nickname, change it
+		// If the client is using a different nickname, change it. The
+		// account's record already has the nickname.
 		if client.Nickname != targetNick {
 			oldNickname := client.Nickname
 			client.Nickname = targetNick
 			updateConnectedClientNickname(oldNickname, targetNick)
-			err := updateClientNickname(client)
-			if err != nil {
-				log.Printf("Error updating client nickname: %v", err)
-				sendNickServMessage(client, "Error updating nickname")
-				return
-			}
-			client.conn.Write([]byte(fmt.Sprintf(":%s NICK %s\r\n", oldNickname, targetNick)))
+			client.send(newMessage(oldNickname, "NICK", targetNick))
 			notifyNicknameChange(client, oldNickname, targetNick)
 		}
 
 		client.ID = existingClient.ID // Ensure the client has the correct ID
 		client.IsIdentified = true
+		client.Account = existingClient.Nickname
+		client.AccountID = existingClient.ID
+		if _, err := getScramCredentials(client.ID); err != nil {
+			if err := setScramPassword(client.ID, password); err != nil {
+				log.Printf("Error saving SCRAM credentials for %s: %v", targetNick, err)
+			}
+		}
 		client.LastSeen = time.Now()
 		err = updateClientInfo(client)
 		if err != nil {
@@ -172,7 +172,7 @@ func handleNickServSetPassword(client *Client, args []string) {
 	}
 
 	// Update the password in the database
-	_, err = DB.Exec("UPDATE users SET password = ? WHERE nickname = ?", string(hashedPassword), client.Nickname)
+	_, err = DB.Exec("UPDATE users SET password = ? WHERE id = ?", string(hashedPassword), client.ID)
 	if err != nil {
 		log.Printf("Error updating client password: %v", err)
 		client.sendNumeric(ERR_UNKNOWNERROR, "Error changing password")
@@ -180,7 +180,10 @@ func handleNickServSetPassword(client *Client, args []string) {
 	}
 
 	client.Password = string(hashedPassword)
-	client.sendNumeric(RPL_NOTICE, "NickServ", "Password changed successfully")
+	if err := setScramPassword(client.ID, newPassword); err != nil {
+		log.Printf("Error saving SCRAM credentials for %s: %v", client.Nickname, err)
+	}
+	sendNickServMessage(client, "Password changed successfully")
 }
 
 func handleNickServInfo(client *Client, args []string) {
@@ -196,10 +199,10 @@ func handleNickServInfo(client *Client, args []string) {
 		return
 	}
 
-	client.sendNumeric(RPL_NOTICE, "NickServ", fmt.Sprintf("Information for %s:", targetNick))
-	client.sendNumeric(RPL_NOTICE, "NickServ", fmt.Sprintf("Registered on: %s", targetClient.CreatedAt.Format(time.RFC1123)))
-	client.sendNumeric(RPL_NOTICE, "NickServ", fmt.Sprintf("Last seen: %s", targetClient.LastSeen.Format(time.RFC1123)))
-	client.sendNumeric(RPL_NOTICE, "NickServ", fmt.Sprintf("Email: %s", targetClient.Email))
+	sendNickServMessage(client, fmt.Sprintf("Information for %s:", targetNick))
+	sendNickServMessage(client, fmt.Sprintf("Registered on: %s", targetClient.CreatedAt.Format(time.RFC1123)))
+	sendNickServMessage(client, fmt.Sprintf("Last seen: %s", targetClient.LastSeen.Format(time.RFC1123)))
+	sendNickServMessage(client, fmt.Sprintf("Email: %s", targetClient.Email))
 }
 
 func handleNickServGhost(client *Client, args []string) {
@@ -224,22 +227,16 @@ func handleNickServGhost(client *Client, args []string) {
 	connectedClient := findClientByNickname(targetNick)
 	if connectedClient != nil {
 		// Disconnect the old session
-		connectedClient.sendNumeric(RPL_NOTICE, "NickServ", "This nickname has been ghosted")
+		sendNickServMessage(connectedClient, "This nickname has been ghosted")
 		handleQuit(connectedClient, "Ghosted")
 	}
 
-	client.sendNumeric(RPL_NOTICE, "NickServ", fmt.Sprintf("Ghost with nickname %s has been disconnected", targetNick))
+	sendNickServMessage(client, fmt.Sprintf("Ghost with nickname %s has been disconnected", targetNick))
 }
 
 // Helper functions
 
-func (client *Client) sendNumeric(numeric string, params ...string) {
-	message := fmt.Sprintf(":%s %s %s :%s\r\n", ServerNameString, numeric, client.Nickname, strings.Join(params, " "))
-	client.conn.Write([]byte(message))
-}
-
 func verifyPassword(hashedPassword, password string) bool {
-	log.Printf("Comparing hashedPassword: '%s' with password: '%s'", hashedPassword, password)
 	if hashedPassword == "" {
 		log.Printf("Error: Stored hashed password is empty")
 		return false
@@ -253,5 +250,5 @@ func verifyPassword(hashedPassword, password string) bool {
 }
 
 func sendNickServMessage(client *Client, message string) {
-	client.conn.Write([]byte(fmt.Sprintf(":%s NOTICE %s :%s\r\n", NickServNick, client.Nickname, message)))
+	client.sendNotice(NickServNick, message)
 }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Operator privileges, granted through the classes in oper_classes.
+const (
+	privKill         = "kill"
+	privKline        = "kline"
+	privRehash       = "rehash"
+	privDie          = "die"
+	privSeeInvisible = "see-invisible"
+	privWallops      = "wallops"
+)
+
+var operPrivileges = []string{privKill, privKline, privRehash, privDie, privSeeInvisible, privWallops}
+
+// OperatorConfig is an operator block: who may OPER as name, from where.
+type OperatorConfig struct {
+	Name string `json:"name"`
+	// Password is a bcrypt hash, as printed by squish -mkpasswd.
+	Password string `json:"password"`
+	// Hosts are the addresses or CIDR ranges, such as "192.0.2.0/24", the
+	// operator must connect from, optionally as user@address to also require
+	// a username. Hostnames aren't accepted: the client supplies its own.
+	Hosts []string `json:"hosts"`
+	Class string   `json:"class"`
+}
+
+func findOperator(name string) *OperatorConfig {
+	operators := config().Operators
+	for i := range operators {
+		if operators[i].Name == name {
+			return &operators[i]
+		}
+	}
+	return nil
+}
+
+// splitOperHost splits an operator host entry into its username mask and
+// address range.
+func splitOperHost(host string) (string, *net.IPNet, error) {
+	user, address, found := strings.Cut(host, "@")
+	if !found {
+		user, address = "*", host
+	}
+	network, err := parseAddressMask(address)
+	return user, network, err
+}
+
+// matchesHost reports whether the client's connection comes from one of the
+// operator's hosts. Only the real address is checked, never the hostname.
+func (oper *OperatorConfig) matchesHost(client *Client) bool {
+	ip := client.ip()
+	if ip == nil {
+		return false
+	}
+	for _, host := range oper.Hosts {
+		user, network, err := splitOperHost(host)
+		if err == nil && network.Contains(ip) && globMatch(user, client.Username) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleOper makes the client an IRC operator if the name, password and
+// the host it connects from match an operator block.
+func handleOper(client *Client, msg *Message) {
+	if len(msg.Params) < 2 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "OPER", "Not enough parameters")
+		return
+	}
+	name, password := msg.Params[0], msg.Params[1]
+
+	oper := findOperator(name)
+	if oper == nil || !oper.matchesHost(client) {
+		log.Printf("Failed OPER attempt as %s by %s: no matching operator block", name, client.hostmask())
+		client.sendNumeric(ERR_NOOPERHOST, "No O-lines for your host")
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(oper.Password), []byte(password)); err != nil {
+		log.Printf("Failed OPER attempt as %s by %s: wrong password", name, client.hostmask())
+		client.sendNumeric(ERR_PASSWDMISMATCH, "Password incorrect")
+		return
+	}
+
+	client.IsOperator = true
+	client.OperName = oper.Name
+	client.operClass = oper.Class
+	log.Printf("%s is now an IRC operator (%s, class %s)", client.hostmask(), oper.Name, oper.Class)
+
+	client.send(newMessage(client.Nickname, "MODE", client.Nickname, "+o"))
+	client.sendNumeric(RPL_YOUREOPER, "You are now an IRC operator")
+	client.sendNotice(ServerNameString, "Your privileges: "+strings.Join(config().OperClasses[oper.Class], ", "))
+}
+
+// deoper drops the client's IRC operator status.
+func (client *Client) deoper() {
+	log.Printf("%s is no longer an IRC operator (%s)", client.hostmask(), client.OperName)
+	client.IsOperator = false
+	client.OperName = ""
+	client.operClass = ""
+	client.snomask = ""
+}
+
+// hasOperPrivilege reports whether the client is an IRC operator whose
+// class grants priv. Classes are looked up on every check, so a REHASH
+// takes effect for operators who are already logged in.
+func (client *Client) hasOperPrivilege(priv string) bool {
+	return client.IsOperator && slices.Contains(config().OperClasses[client.operClass], priv)
+}
+
+// requireOperPrivilege sends ERR_NOPRIVILEGES and returns false unless the
+// client holds priv.
+func (client *Client) requireOperPrivilege(priv string) bool {
+	if client.hasOperPrivilege(priv) {
+		return true
+	}
+	if client.IsOperator {
+		client.sendNumeric(ERR_NOPRIVILEGES, "Permission Denied- You don't have the "+priv+" privilege")
+	} else {
+		client.sendNumeric(ERR_NOPRIVILEGES, "Permission Denied- You're not an IRC operator")
+	}
+	return false
+}
+
+// printPasswordHash reads a password from stdin and prints its bcrypt hash,
+// for the password field of an operator block.
+func printPasswordHash() error {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(password, "\r\n")), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(hash))
+	return nil
+}
+
+// handleKill disconnects a user, who quits with "Killed (oper (reason))".
+func handleKill(client *Client, msg *Message) {
+	if !client.requireOperPrivilege(privKill) {
+		return
+	}
+	if len(msg.Params) < 1 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "KILL", "Not enough parameters")
+		return
+	}
+	targetNick := msg.Params[0]
+	reason := msg.Param(1)
+	if reason == "" {
+		reason = "No reason given"
+	}
+
+	if strings.EqualFold(targetNick, ServerNameString) || strings.EqualFold(targetNick, "ChanServ") || strings.EqualFold(targetNick, "NickServ") {
+		client.sendNumeric(ERR_CANTKILLSERVER, "You can't kill a server!")
+		return
+	}
+	target := findClientByNickname(targetNick)
+	if target == nil {
+		client.sendNumeric(ERR_NOSUCHNICK, targetNick, "No such nick/channel")
+		return
+	}
+
+	log.Printf("%s killed %s: %s", client.hostmask(), target.hostmask(), reason)
+	sendServerNotice('k', "Received KILL message for %s (%s@%s). From %s (%s)", target.Nickname, target.Username, target.Hostname, client.Nickname, reason)
+	target.send(newMessage(client.hostmask(), "KILL", target.Nickname, reason))
+	target.disconnect(fmt.Sprintf("Killed (%s (%s))", client.Nickname, reason))
+}
+
+// handleWallops sends a message to every user with +w.
+func handleWallops(client *Client, msg *Message) {
+	if !client.requireOperPrivilege(privWallops) {
+		return
+	}
+	if len(msg.Params) < 1 || msg.Params[0] == "" {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "WALLOPS", "Not enough parameters")
+		return
+	}
+
+	wallops := newRelayMessage(client.hostmask(), "WALLOPS", msg.Params[0])
+	for _, c := range connectedClientList() {
+		if c.Wallops {
+			c.send(wallops)
+		}
+	}
+}
+
+// handleGlobops sends a notice to every IRC operator.
+func handleGlobops(client *Client, msg *Message) {
+	if !client.requireOperPrivilege(privWallops) {
+		return
+	}
+	if len(msg.Params) < 1 || msg.Params[0] == "" {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "GLOBOPS", "Not enough parameters")
+		return
+	}
+	sendOperNotice(fmt.Sprintf("*** Global -- from %s: %s", client.Nickname, msg.Params[0]))
+}
+
+// sendOperNotice sends a server notice to every IRC operator.
+func sendOperNotice(text string) {
+	for _, c := range connectedClientList() {
+		if c.IsOperator {
+			c.sendNotice(ServerNameString, text)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// rehash rereads the config file and the MOTD and applies them to the
+// running server. Settings that only take effect at startup keep their old
+// values; the returned warnings name any that changed.
+func rehash() (warnings []string, err error) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	old := config()
+	if cfg.ServerName != old.ServerName {
+		warnings = append(warnings, "server_name")
+		cfg.ServerName = old.ServerName
+	}
+	if !slices.Equal(cfg.Listeners, old.Listeners) {
+		warnings = append(warnings, "listeners")
+		cfg.Listeners = old.Listeners
+	}
+	if cfg.DatabasePath != old.DatabasePath {
+		warnings = append(warnings, "database_path")
+		cfg.DatabasePath = old.DatabasePath
+	}
+
+	wasAvailable := make([]bool, len(capabilities))
+	for i, c := range capabilities {
+		wasAvailable[i] = c.isAvailable()
+	}
+
+	currentConfig.Store(cfg)
+
+	if err := loadMotd(); err != nil {
+		log.Printf("Failed to read MOTD file: %v", err)
+	}
+	initializeDefaultChannels()
+	reloadCertificates()
+
+	// Tell cap-notify clients about capabilities the new config turned on
+	// or off, such as chathistory
+	var added, removed []capability
+	for i, c := range capabilities {
+		switch now := c.isAvailable(); {
+		case now && !wasAvailable[i]:
+			added = append(added, c)
+		case !now && wasAvailable[i]:
+			removed = append(removed, c)
+		}
+	}
+	if len(added) > 0 {
+		notifyCapChange("NEW", added)
+	}
+	if len(removed) > 0 {
+		notifyCapChange("DEL", removed)
+	}
+	return warnings, nil
+}
+
+func handleRehash(client *Client, msg *Message) {
+	if !client.requireOperPrivilege(privRehash) {
+		return
+	}
+	// Without -config the server runs on the defaults and there is no file
+	// to reread
+	if configPath == "" {
+		client.sendNotice(ServerNameString, "Not rehashing: the server wasn't started with a config file")
+		return
+	}
+
+	client.sendNumeric(RPL_REHASHING, configPath, "Rehashing")
+	log.Printf("%s is rehashing the server config", client.hostmask())
+	warnings, err := rehash()
+	if err != nil {
+		log.Printf("Rehash failed, keeping the old config: %v", err)
+		client.sendNotice(ServerNameString, "Rehash failed, keeping the old config: "+err.Error())
+		return
+	}
+	sendOperNotice(fmt.Sprintf("%s rehashed the server config", client.Nickname))
+	for _, setting := range warnings {
+		client.sendNotice(ServerNameString, setting+" changed but only takes effect after a restart")
+	}
+}
+
+// shutdownTimeout bounds how long DIE and RESTART wait for clients to be
+// sent their last messages.
+const shutdownTimeout = 5 * time.Second
+
+// handleDie handles DIE and, with restart set, RESTART. Both take an
+// optional reason.
+func handleDie(client *Client, msg *Message, restart bool) {
+	if !client.requireOperPrivilege(privDie) {
+		return
+	}
+	reason := msg.Param(0)
+	if reason == "" {
+		reason = "No reason given"
+	}
+	// A config the new process can't load would leave no server at all
+	if restart {
+		if _, err := loadConfig(configPath); err != nil {
+			client.sendNotice(ServerNameString, "Not restarting: "+err.Error())
+			return
+		}
+	}
+
+	// The shutdown disconnects this client too, so it can't run on the
+	// client's own goroutine
+	go shutdown(client.Nickname, reason, restart)
+}
+
+// shutdown disconnects everyone, stops accepting connections and exits, or
+// re-executes the binary if restart is set.
+func shutdown(by, reason string, restart bool) {
+	action, quit := "shutting down", "Server shutting down"
+	if restart {
+		action, quit = "restarting", "Server restarting"
+	}
+	log.Printf("%s is %s the server: %s", by, action, reason)
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	for _, c := range connectedClientList() {
+		c.sendNotice(ServerNameString, fmt.Sprintf("*** Server %s by %s: %s", action, by, reason))
+		c.disconnect(quit)
+	}
+
+	deadline := time.Now().Add(shutdownTimeout)
+	for len(connectedClientList()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := DB.Close(); err != nil {
+		log.Printf("Error closing database: %v", err)
+	}
+
+	if restart {
+		executable, err := os.Executable()
+		if err != nil {
+			log.Fatalf("Failed to restart: %v", err)
+		}
+		err = syscall.Exec(executable, os.Args, os.Environ())
+		log.Fatalf("Failed to restart: %v", err)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// saslChunkSize is the most base64 an AUTHENTICATE line carries; a full
+	// chunk means more is coming.
+	saslChunkSize = 400
+	// saslMaxResponse caps the base64 a client may send for one step.
+	saslMaxResponse = 8192
+	// maxSASLFailures is how many failed exchanges a connection gets before
+	// it is disconnected, so passwords can't be guessed without limit.
+	maxSASLFailures = 3
+
+	scramIterations = 4096
+	scramSaltSize   = 16
+)
+
+// saslMechanisms lists the supported mechanisms in the order they are
+// advertised.
+var saslMechanisms = []string{"PLAIN", "SCRAM-SHA-256"}
+
+// saslSession is an authentication exchange in progress.
+type saslSession struct {
+	mechanism string
+	buffer    strings.Builder
+	scram     *scramExchange
+}
+
+// scramExchange is the server side of a SCRAM-SHA-256 exchange.
+type scramExchange struct {
+	account         string
+	accountID       int64
+	creds           *scramCredentials
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	verified        bool
+}
+
+func handleAuthenticate(client *Client, msg *Message) {
+	if len(msg.Params) < 1 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "AUTHENTICATE", "Not enough parameters")
+		return
+	}
+	if !client.hasCap(capSASL) {
+		client.sendNumeric(ERR_SASLFAIL, "SASL authentication failed: sasl capability not enabled")
+		return
+	}
+	if client.Account != "" {
+		client.sendNumeric(ERR_SASLALREADY, "You have already authenticated using SASL")
+		return
+	}
+
+	arg := msg.Params[0]
+
+	if client.sasl == nil {
+		mechanism := strings.ToUpper(arg)
+		if !isSASLMechanism(mechanism) {
+			client.sendNumeric(RPL_SASLMECHS, saslCapValue(), "are available SASL mechanisms")
+			client.sendNumeric(ERR_SASLFAIL, "SASL authentication failed")
+			return
+		}
+		client.sasl = &saslSession{mechanism: mechanism}
+		client.send(newMessage(ServerNameString, "AUTHENTICATE", "+"))
+		return
+	}
+
+	if arg == "*" {
+		abortSASL(client)
+		return
+	}
+	if len(arg) > saslChunkSize {
+		client.sasl = nil
+		client.sendNumeric(ERR_SASLTOOLONG, "SASL message too long")
+		return
+	}
+
+	if arg != "+" {
+		client.sasl.buffer.WriteString(arg)
+	}
+	if client.sasl.buffer.Len() > saslMaxResponse {
+		client.sasl = nil
+		client.sendNumeric(ERR_SASLTOOLONG, "SASL message too long")
+		return
+	}
+	if len(arg) == saslChunkSize {
+		// A full chunk means the response continues on the next line
+		return
+	}
+
+	encoded := client.sasl.buffer.String()
+	client.sasl.buffer.Reset()
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		log.Printf("SASL: invalid base64 from %s: %v", client.conn.RemoteAddr().String(), err)
+		failSASL(client)
+		return
+	}
+
+	switch client.sasl.mechanism {
+	case "PLAIN":
+		handleSASLPlain(client, data)
+	case "SCRAM-SHA-256":
+		handleSASLScram(client, data)
+	}
+}
+
+func isSASLMechanism(mechanism string) bool {
+	for _, m := range saslMechanisms {
+		if m == mechanism {
+			return true
+		}
+	}
+	return false
+}
+
+// sendSASLChallenge sends data to the client, split into base64 chunks.
+func sendSASLChallenge(client *Client, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	if encoded == "" {
+		client.send(newMessage(ServerNameString, "AUTHENTICATE", "+"))
+		return
+	}
+	for len(encoded) > 0 {
+		n := min(len(encoded), saslChunkSize)
+		client.send(newMessage(ServerNameString, "AUTHENTICATE", encoded[:n]))
+		encoded = encoded[n:]
+		if n == saslChunkSize && len(encoded) == 0 {
+			client.send(newMessage(ServerNameString, "AUTHENTICATE", "+"))
+		}
+	}
+}
+
+func succeedSASL(client *Client, accountID int64, account string) {
+	client.sasl = nil
+	client.Account = account
+	client.AccountID = accountID
+	log.Printf("SASL: %s authenticated as %s", client.conn.RemoteAddr().String(), account)
+	client.sendNumeric(RPL_LOGGEDIN, client.hostmask(), account, "You are now logged in as "+account)
+	client.sendNumeric(RPL_SASLSUCCESS, "SASL authentication successful")
+}
+
+func failSASL(client *Client) {
+	client.sasl = nil
+	client.sendNumeric(ERR_SASLFAIL, "SASL authentication failed")
+	client.saslFailures++
+	if client.saslFailures >= maxSASLFailures {
+		log.Printf("SASL: too many failed attempts from %s, disconnecting", client.conn.RemoteAddr().String())
+		client.disconnect("Too many failed SASL attempts")
+	}
+}
+
+// abortSASL cancels an exchange in progress, if there is one.
+func abortSASL(client *Client) {
+	if client.sasl == nil {
+		return
+	}
+	client.sasl = nil
+	client.sendNumeric(ERR_SASLABORTED, "SASL authentication aborted")
+}
+
+// handleSASLPlain verifies "authzid NUL authcid NUL password" against the
+// account's bcrypt hash.
+func handleSASLPlain(client *Client, data []byte) {
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		failSASL(client)
+		return
+	}
+	authzid, authcid, password := string(parts[0]), string(parts[1]), string(parts[2])
+	if authzid != "" && authzid != authcid {
+		failSASL(client)
+		return
+	}
+
+	account, err := getClientByNickname(authcid)
+	if err != nil || !verifyPassword(account.Password, password) {
+		log.Printf("SASL PLAIN failed for %s", authcid)
+		failSASL(client)
+		return
+	}
+
+	// Accounts registered before SCRAM support get their verifiers now
+	if _, err := getScramCredentials(account.ID); err != nil {
+		if err := setScramPassword(account.ID, password); err != nil {
+			log.Printf("Error saving SCRAM credentials for %s: %v", authcid, err)
+		}
+	}
+
+	succeedSASL(client, account.ID, account.Nickname)
+}
+
+// handleSASLScram runs one step of RFC 5802 / RFC 7677 SCRAM-SHA-256.
+// Channel binding is not supported.
+func handleSASLScram(client *Client, data []byte) {
+	exchange := client.sasl.scram
+	switch {
+	case exchange == nil:
+		started, serverFirst, err := startScram(string(data))
+		if err != nil {
+			log.Printf("SASL SCRAM-SHA-256 failed for %s: %v", client.conn.RemoteAddr().String(), err)
+			failSASL(client)
+			return
+		}
+		client.sasl.scram = started
+		sendSASLChallenge(client, []byte(serverFirst))
+	case !exchange.verified:
+		serverFinal, err := exchange.verify(string(data))
+		if err != nil {
+			log.Printf("SASL SCRAM-SHA-256 failed for %s: %v", exchange.account, err)
+			failSASL(client)
+			return
+		}
+		exchange.verified = true
+		sendSASLChallenge(client, []byte(serverFinal))
+	default:
+		// The client acknowledges the server signature with an empty response
+		if len(data) != 0 {
+			failSASL(client)
+			return
+		}
+		succeedSASL(client, exchange.accountID, exchange.account)
+	}
+}
+
+// startScram parses the client-first-message and builds the
+// server-first-message.
+func startScram(clientFirst string) (*scramExchange, string, error) {
+	// gs2-header is "n,," or "y,," optionally with an authzid: "n,a=name,"
+	var gs2Header string
+	switch {
+	case strings.HasPrefix(clientFirst, "n,"), strings.HasPrefix(clientFirst, "y,"):
+		end := strings.Index(clientFirst[2:], ",")
+		if end < 0 {
+			return nil, "", fmt.Errorf("malformed gs2 header")
+		}
+		gs2Header = clientFirst[:2+end+1]
+	case strings.HasPrefix(clientFirst, "p="):
+		return nil, "", fmt.Errorf("channel binding is not supported")
+	default:
+		return nil, "", fmt.Errorf("malformed gs2 header")
+	}
+
+	bare := clientFirst[len(gs2Header):]
+	attrs := parseScramAttributes(bare)
+	username, clientNonce := scramUnescape(attrs["n"]), attrs["r"]
+	if username == "" || clientNonce == "" {
+		return nil, "", fmt.Errorf("missing username or nonce")
+	}
+
+	authzid := strings.TrimPrefix(strings.Trim(gs2Header[2:], ","), "a=")
+	if authzid != "" && scramUnescape(authzid) != username {
+		return nil, "", fmt.Errorf("authzid %q does not match %q", authzid, username)
+	}
+
+	account, err := getClientByNickname(username)
+	if err != nil {
+		return nil, "", fmt.Errorf("unknown account %s", username)
+	}
+	creds, err := getScramCredentials(account.ID)
+	if err != nil {
+		return nil, "", fmt.Errorf("no SCRAM credentials for %s", username)
+	}
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, "", err
+	}
+
+	exchange := &scramExchange{
+		account:         account.Nickname,
+		accountID:       account.ID,
+		creds:           creds,
+		gs2Header:       gs2Header,
+		clientFirstBare: bare,
+		nonce:           clientNonce + base64.StdEncoding.EncodeToString(serverNonce),
+	}
+	exchange.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", exchange.nonce, base64.StdEncoding.EncodeToString(creds.Salt), creds.Iterations)
+	return exchange, exchange.serverFirst, nil
+}
+
+// verify checks the client proof in the client-final-message and returns
+// the server-final-message.
+func (e *scramExchange) verify(clientFinal string) (string, error) {
+	proofIndex := strings.LastIndex(clientFinal, ",p=")
+	if proofIndex < 0 {
+		return "", fmt.Errorf("missing proof")
+	}
+	withoutProof := clientFinal[:proofIndex]
+	attrs := parseScramAttributes(withoutProof)
+
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(e.gs2Header)) {
+		return "", fmt.Errorf("channel binding mismatch")
+	}
+	if attrs["r"] != e.nonce {
+		return "", fmt.Errorf("nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[proofIndex+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return "", fmt.Errorf("malformed proof")
+	}
+
+	authMessage := e.clientFirstBare + "," + e.serverFirst + "," + withoutProof
+	clientSignature := scramHMAC(e.creds.StoredKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	for i := range clientKey {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], e.creds.StoredKey) != 1 {
+		return "", fmt.Errorf("invalid proof")
+	}
+
+	serverSignature := scramHMAC(e.creds.ServerKey, authMessage)
+	return "v=" + base64.StdEncoding.EncodeToString(serverSignature), nil
+}
+
+func parseScramAttributes(message string) map[string]string {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(message, ",") {
+		if len(field) >= 2 && field[1] == '=' {
+			attrs[field[:1]] = field[2:]
+		}
+	}
+	return attrs
+}
+
+func scramUnescape(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// setScramPassword derives and stores SCRAM-SHA-256 verifiers for a user.
+// It is called wherever the plaintext password is known.
+func setScramPassword(userID int64, password string) error {
+	salt := make([]byte, scramSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	salted := pbkdf2.Key([]byte(password), salt, scramIterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	return saveScramCredentials(&scramCredentials{
+		UserID:     userID,
+		Salt:       salt,
+		Iterations: scramIterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(salted, "Server Key"),
+	})
+}
+
+// saslCapValue is the value advertised for the sasl capability.
+func saslCapValue() string {
+	return strings.Join(saslMechanisms, ",")
+}
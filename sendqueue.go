@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// writeTimeout bounds how long the writer waits on a single socket write
+// before giving up on the client.
+const writeTimeout = 30 * time.Second
+
+// startWriter gives the client its outbound queue and the goroutine that
+// drains it. Nothing is written to the connection except by that goroutine.
+func (client *Client) startWriter() {
+	client.sendReady = make(chan struct{}, 1)
+	client.writerDone = make(chan struct{})
+	go client.writeLoop()
+}
+
+func (client *Client) send(msg *Message) {
+	client.enqueue([]byte(msg.forClient(client).String() + "\r\n"))
+}
+
+// enqueue appends a line to the send queue without blocking. A client whose
+// queue grows past the configured SendQ is disconnected.
+func (client *Client) enqueue(line []byte) {
+	if client.sendReady == nil {
+		return
+	}
+
+	client.sendMu.Lock()
+	if client.sendClosed {
+		client.sendMu.Unlock()
+		return
+	}
+	if client.sendQBytes+len(line) > config().Limits.SendQ {
+		client.sendQueue = nil
+		client.sendQBytes = 0
+		client.sendClosed = true
+		client.quitReason = "SendQ exceeded"
+		client.sendMu.Unlock()
+
+		log.Printf("SendQ exceeded for %s, disconnecting", client.nickOrStar())
+		// Closing the connection wakes the reader, which runs the normal
+		// disconnect path with the reason recorded above.
+		client.conn.Close()
+		client.wakeWriter()
+		return
+	}
+	client.sendQueue = append(client.sendQueue, line)
+	client.sendQBytes += len(line)
+	client.sendMu.Unlock()
+
+	client.wakeWriter()
+}
+
+func (client *Client) wakeWriter() {
+	select {
+	case client.sendReady <- struct{}{}:
+	default:
+	}
+}
+
+func (client *Client) writeLoop() {
+	defer close(client.writerDone)
+
+	for range client.sendReady {
+		client.sendMu.Lock()
+		queue := client.sendQueue
+		client.sendQueue = nil
+		client.sendQBytes = 0
+		closed := client.sendClosed
+		client.sendMu.Unlock()
+
+		for _, line := range queue {
+			client.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := client.conn.Write(line); err != nil {
+				log.Printf("Error sending message to %s: %v", client.nickOrStar(), err)
+				client.sendMu.Lock()
+				client.sendClosed = true
+				client.sendQueue = nil
+				client.sendMu.Unlock()
+				client.conn.Close()
+				return
+			}
+		}
+
+		if closed {
+			client.conn.Close()
+			return
+		}
+	}
+}
+
+// closeSendQueue stops accepting new messages. Whatever is already queued is
+// flushed before the writer closes the connection.
+func (client *Client) closeSendQueue() {
+	if client.sendReady == nil {
+		return
+	}
+
+	client.sendMu.Lock()
+	client.sendClosed = true
+	client.sendMu.Unlock()
+
+	client.wakeWriter()
+}
+
+// waitForWriter waits for the writer to flush and exit, giving up after
+// writeTimeout.
+func (client *Client) waitForWriter() {
+	if client.writerDone == nil {
+		return
+	}
+
+	select {
+	case <-client.writerDone:
+	case <-time.After(writeTimeout):
+		log.Printf("Timed out flushing the send queue for %s", client.nickOrStar())
+	}
+}
+
+// disconnect closes the client's connection for reason, which becomes its
+// quit message. Anything already queued, and the ERROR, is sent first; the
+// client's own goroutine then runs the normal disconnect path.
+func (client *Client) disconnect(reason string) {
+	client.setQuitReason(reason)
+	client.send(newMessage("", "ERROR", fmt.Sprintf("Closing Link: %s (%s)", client.nickOrStar(), reason)))
+	client.closeSendQueue()
+}
+
+// setQuitReason records why the server is closing the connection, keeping
+// the first reason if there is already one.
+func (client *Client) setQuitReason(reason string) {
+	client.sendMu.Lock()
+	defer client.sendMu.Unlock()
+	if client.quitReason == "" {
+		client.quitReason = reason
+	}
+}
+
+// closeQuitReason returns the reason the server closed the connection, if
+// it was the server's decision.
+func (client *Client) closeQuitReason() string {
+	client.sendMu.Lock()
+	defer client.sendMu.Unlock()
+	return client.quitReason
+}
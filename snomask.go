@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// snomaskTypes are the kinds of server notice an operator can subscribe to
+// with user mode +s, e.g. "MODE nick +s +cx".
+var snomaskTypes = []struct {
+	letter      rune
+	description string
+}{
+	{'c', "client connects and exits"},
+	{'f', "flooding and Excess Flood disconnects"},
+	{'k', "kills"},
+	{'n', "nick changes"},
+	{'x', "K-lines and D-lines being added, removed, expiring and taking effect"},
+}
+
+func snomaskLetters() string {
+	var letters strings.Builder
+	for _, kind := range snomaskTypes {
+		letters.WriteRune(kind.letter)
+	}
+	return letters.String()
+}
+
+// applySnomask applies a change such as "+cx", "-n" or "cx" (taken as
+// adding) to a snomask and returns the result in canonical order. Unknown
+// letters are ignored.
+func applySnomask(current, change string) string {
+	enabled := make(map[rune]bool)
+	for _, letter := range current {
+		enabled[letter] = true
+	}
+	adding := true
+	for _, letter := range change {
+		switch letter {
+		case '+', '-':
+			adding = letter == '+'
+		default:
+			enabled[letter] = adding
+		}
+	}
+
+	var snomask strings.Builder
+	for _, kind := range snomaskTypes {
+		if enabled[kind.letter] {
+			snomask.WriteRune(kind.letter)
+		}
+	}
+	return snomask.String()
+}
+
+// sendServerNotice sends a server notice to every operator whose snomask
+// includes letter.
+func sendServerNotice(letter rune, format string, args ...any) {
+	text := "*** Notice -- " + fmt.Sprintf(format, args...)
+	for _, c := range connectedClientList() {
+		if c.IsOperator && strings.ContainsRune(c.snomask, letter) {
+			c.sendNotice(ServerNameString, text)
+		}
+	}
+}
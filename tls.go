@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certPollInterval is how often certificate files are checked for changes.
+const certPollInterval = 30 * time.Second
+
+// certReloader serves the current certificate for a TLS listener and swaps
+// it out when the files on disk change. Connections that are already
+// established keep the certificate they were handshaked with.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+var (
+	certReloaders      []*certReloader
+	certReloadersMutex sync.Mutex
+)
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	certReloadersMutex.Lock()
+	certReloaders = append(certReloaders, reloader)
+	certReloadersMutex.Unlock()
+
+	return reloader, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate %s: %v", r.certFile, err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	log.Printf("Loaded TLS certificate %s", r.certFile)
+	return nil
+}
+
+// filesModTime returns the newest modification time of the cert and key.
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var newest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error reading %s: %v", path, err)
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+func (r *certReloader) changed() bool {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		log.Printf("Error checking TLS certificate %s: %v", r.certFile, err)
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !modTime.Equal(r.modTime)
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func newTLSConfig(reloader *certReloader) *tls.Config {
+	return &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		// Ask for a client certificate so its fingerprint can be recorded,
+		// but don't require or verify one.
+		ClientAuth: tls.RequestClientCert,
+	}
+}
+
+// reloadCertificates reloads every TLS listener's certificate. A failed
+// reload keeps the previous certificate in service.
+func reloadCertificates() {
+	certReloadersMutex.Lock()
+	defer certReloadersMutex.Unlock()
+
+	for _, reloader := range certReloaders {
+		if err := reloader.reload(); err != nil {
+			log.Printf("Error reloading TLS certificate, keeping the old one: %v", err)
+		}
+	}
+}
+
+// watchCertificates reloads certificates on SIGHUP and whenever the files
+// on disk change.
+func watchCertificates() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hangup:
+			log.Println("Received SIGHUP, reloading TLS certificates")
+			reloadCertificates()
+		case <-ticker.C:
+			certReloadersMutex.Lock()
+			for _, reloader := range certReloaders {
+				if !reloader.changed() {
+					continue
+				}
+				log.Printf("TLS certificate %s changed on disk, reloading", reloader.certFile)
+				if err := reloader.reload(); err != nil {
+					log.Printf("Error reloading TLS certificate, keeping the old one: %v", err)
+				}
+			}
+			certReloadersMutex.Unlock()
+		}
+	}
+}
+
+// completeTLSHandshake finishes the handshake on a TLS connection and
+// records the result on the client. Plaintext connections are left alone.
+func completeTLSHandshake(client *Client) error {
+	tlsConn, ok := client.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	client.IsSecure = true
+	if len(state.PeerCertificates) > 0 {
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		client.CertFP = hex.EncodeToString(sum[:])
+	}
+	log.Printf("TLS handshake complete for %s (version %s, cipher %s)", tlsConn.RemoteAddr().String(), tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server ban kinds. K-lines match user@host once a client registers;
+// D-lines match the connecting address and are refused at accept.
+const (
+	kindKLine = "K"
+	kindDLine = "D"
+)
+
+// serverBans caches the server_bans table so connections can be checked
+// without a query. It is reloaded whenever the table changes.
+var serverBans struct {
+	sync.RWMutex
+	bans []serverBan
+}
+
+func loadServerBans() error {
+	bans, err := getServerBans()
+	if err != nil {
+		return err
+	}
+	serverBans.Lock()
+	serverBans.bans = bans
+	serverBans.Unlock()
+	return nil
+}
+
+func (ban *serverBan) expired(now time.Time) bool {
+	return ban.ExpiresAt.Valid && ban.ExpiresAt.Int64 <= now.Unix()
+}
+
+func (ban *serverBan) label() string {
+	return ban.Kind + "-line"
+}
+
+// quitMessage is what a client removed by the ban quits with.
+func (ban *serverBan) quitMessage() string {
+	return fmt.Sprintf("%sd (%s)", ban.label(), ban.Reason)
+}
+
+// findServerBan returns the first unexpired ban of kind that match accepts.
+func findServerBan(kind string, match func(ban *serverBan) bool) *serverBan {
+	now := time.Now()
+	serverBans.RLock()
+	defer serverBans.RUnlock()
+	for i := range serverBans.bans {
+		ban := &serverBans.bans[i]
+		if ban.Kind == kind && !ban.expired(now) && match(ban) {
+			found := *ban
+			return &found
+		}
+	}
+	return nil
+}
+
+// dLineFor returns the D-line covering ip, if any. Addresses on the
+// connection exempt list are never D-lined.
+func dLineFor(ip net.IP) *serverBan {
+	if ip == nil || isConnectionExempt(ip) {
+		return nil
+	}
+	return findServerBan(kindDLine, func(ban *serverBan) bool {
+		network, err := parseAddressMask(ban.Mask)
+		return err == nil && network.Contains(ip)
+	})
+}
+
+// serverBan returns the K-line or D-line the client matches, if any.
+func (client *Client) serverBan() *serverBan {
+	if ban := dLineFor(client.ip()); ban != nil {
+		return ban
+	}
+	return findServerBan(kindKLine, func(ban *serverBan) bool {
+		return client.matchesMask("*!" + ban.Mask)
+	})
+}
+
+// rejectBannedClient disconnects a client that matches a server ban and
+// reports whether it did.
+func rejectBannedClient(client *Client) bool {
+	ban := client.serverBan()
+	if ban == nil {
+		return false
+	}
+	log.Printf("%s matches %s %s, disconnecting", client.hostmask(), ban.label(), ban.Mask)
+	sendServerNotice('x', "%s active for %s (%s@%s)", ban.label(), client.nickOrStar(), client.Username, client.Hostname)
+	client.sendNumeric(ERR_YOUREBANNEDCREEP, "You are banned from this server: "+ban.Reason)
+	client.disconnect(ban.quitMessage())
+	return true
+}
+
+// minKLineChars is how many characters other than wildcards and separators
+// a K-line must have, so "*@*.*" and the like can't ban everyone.
+const minKLineChars = 4
+
+// normalizeKLineMask turns a K-line argument into a user@host mask; a bare
+// host bans every user on it. Masks that would match nearly everyone are
+// refused.
+func normalizeKLineMask(mask string) (string, error) {
+	if strings.Contains(mask, "!") {
+		return "", fmt.Errorf("K-lines are user@host masks, not %s", mask)
+	}
+	user, host, found := strings.Cut(mask, "@")
+	if !found {
+		user, host = "*", mask
+	}
+	if user == "" {
+		user = "*"
+	}
+	literal := strings.Map(func(r rune) rune {
+		if strings.ContainsRune("*?.:@", r) {
+			return -1
+		}
+		return r
+	}, user+host)
+	if len(literal) < minKLineChars {
+		return "", fmt.Errorf("%s is too broad", mask)
+	}
+	return user + "@" + host, nil
+}
+
+// normalizeDLineMask checks a D-line argument, an IP address or CIDR range
+// no wider than a /8 for IPv4 or a /32 for IPv6.
+func normalizeDLineMask(mask string) (string, error) {
+	network, err := parseAddressMask(mask)
+	if err != nil {
+		return "", err
+	}
+	ones, bits := network.Mask.Size()
+	if ones < bits/4 {
+		return "", fmt.Errorf("%s is too broad", mask)
+	}
+	if ones == bits {
+		return network.IP.String(), nil
+	}
+	return network.String(), nil
+}
+
+// handleServerBan handles KLINE and DLINE:
+//
+//	KLINE [duration] <user@host> [:reason]
+//	DLINE [duration] <ip|cidr> [:reason]
+func handleServerBan(client *Client, msg *Message, kind string) {
+	if !client.requireOperPrivilege(privKline) {
+		return
+	}
+	params := msg.Params
+	var expires sql.NullInt64
+	if len(params) >= 2 {
+		if duration, err := parseListDuration(params[0]); err == nil {
+			expires = sql.NullInt64{Int64: time.Now().Add(duration).Unix(), Valid: true}
+			params = params[1:]
+		}
+	}
+	if len(params) < 1 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, msg.Command, "Not enough parameters")
+		return
+	}
+
+	normalize := normalizeKLineMask
+	if kind == kindDLine {
+		normalize = normalizeDLineMask
+	}
+	mask, err := normalize(params[0])
+	if err != nil {
+		client.sendNotice(ServerNameString, "Invalid mask: "+err.Error())
+		return
+	}
+	reason := "No reason given"
+	if len(params) > 1 && params[1] != "" {
+		reason = params[1]
+	}
+
+	ban := serverBan{Kind: kind, Mask: mask, Reason: reason, SetBy: client.hostmask(), SetAt: time.Now().Unix(), ExpiresAt: expires}
+	if err := addServerBan(ban); err != nil {
+		log.Printf("Error adding %s for %s: %v", ban.label(), mask, err)
+		client.sendNumeric(ERR_UNKNOWNERROR, msg.Command, "Error adding "+ban.label())
+		return
+	}
+	if err := loadServerBans(); err != nil {
+		log.Printf("Error reloading server bans: %v", err)
+	}
+
+	duration := "permanent"
+	if expires.Valid {
+		duration = "until " + time.Unix(expires.Int64, 0).UTC().Format(time.RFC3339)
+	}
+	log.Printf("%s added %s for %s (%s): %s", client.hostmask(), ban.label(), mask, duration, reason)
+	sendServerNotice('x', "%s added %s for %s (%s): %s", client.Nickname, ban.label(), mask, duration, reason)
+
+	// Remove everyone the new ban covers right away
+	for _, c := range connectedClientList() {
+		rejectBannedClient(c)
+	}
+}
+
+// handleRemoveServerBan handles UNKLINE and UNDLINE.
+func handleRemoveServerBan(client *Client, msg *Message, kind string) {
+	if !client.requireOperPrivilege(privKline) {
+		return
+	}
+	if len(msg.Params) < 1 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, msg.Command, "Not enough parameters")
+		return
+	}
+
+	mask := msg.Params[0]
+	if kind == kindKLine && !strings.Contains(mask, "@") {
+		mask = "*@" + mask
+	} else if kind == kindDLine {
+		if normalized, err := normalizeDLineMask(mask); err == nil {
+			mask = normalized
+		}
+	}
+
+	label := kind + "-line"
+	removed, err := removeServerBan(kind, mask)
+	if err != nil {
+		log.Printf("Error removing %s for %s: %v", label, mask, err)
+		client.sendNumeric(ERR_UNKNOWNERROR, msg.Command, "Error removing "+label)
+		return
+	}
+	if !removed {
+		client.sendNotice(ServerNameString, fmt.Sprintf("No %s for %s", label, mask))
+		return
+	}
+	if err := loadServerBans(); err != nil {
+		log.Printf("Error reloading server bans: %v", err)
+	}
+
+	log.Printf("%s removed %s for %s", client.hostmask(), label, mask)
+	sendServerNotice('x', "%s removed %s for %s", client.Nickname, label, mask)
+}
+
+// handleStats answers STATS k (K-lines) and STATS d (D-lines) for operators
+// who can set them. Other queries just end the list.
+func handleStats(client *Client, msg *Message) {
+	if len(msg.Params) < 1 {
+		client.sendNumeric(ERR_NEEDMOREPARAMS, "STATS", "Not enough parameters")
+		return
+	}
+	query := msg.Params[0]
+
+	var kind string
+	switch strings.ToLower(query) {
+	case "k":
+		kind = kindKLine
+	case "d":
+		kind = kindDLine
+	}
+	if kind != "" {
+		if !client.requireOperPrivilege(privKline) {
+			return
+		}
+		serverBans.RLock()
+		bans := append([]serverBan(nil), serverBans.bans...)
+		serverBans.RUnlock()
+
+		now := time.Now()
+		for _, ban := range bans {
+			if ban.Kind != kind || ban.expired(now) {
+				continue
+			}
+			reason := fmt.Sprintf("%s (set by %s at %s", ban.Reason, ban.SetBy, time.Unix(ban.SetAt, 0).UTC().Format(time.RFC3339))
+			if ban.ExpiresAt.Valid {
+				reason += ", expires " + time.Unix(ban.ExpiresAt.Int64, 0).UTC().Format(time.RFC3339)
+			}
+			reason += ")"
+			if kind == kindKLine {
+				user, host, _ := strings.Cut(ban.Mask, "@")
+				client.sendNumeric(RPL_STATSKLINE, "K", host, "*", user, reason)
+			} else {
+				client.sendNumeric(RPL_STATSDLINE, "D", ban.Mask, reason)
+			}
+		}
+	}
+	client.sendNumeric(RPL_ENDOFSTATS, query, "End of /STATS report")
+}
+
+// expireServerBans removes server bans whose time is up. It runs with the
+// periodic maintenance.
+func expireServerBans() {
+	bans, err := removeExpiredServerBans(time.Now())
+	if err != nil {
+		log.Printf("Error expiring server bans: %v", err)
+		return
+	}
+	if len(bans) == 0 {
+		return
+	}
+	for _, ban := range bans {
+		log.Printf("Expired %s for %s (set by %s)", ban.label(), ban.Mask, ban.SetBy)
+		sendServerNotice('x', "%s for %s expired (set by %s)", ban.label(), ban.Mask, ban.SetBy)
+	}
+	if err := loadServerBans(); err != nil {
+		log.Printf("Error reloading server bans: %v", err)
+	}
+}